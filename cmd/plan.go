@@ -0,0 +1,61 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/stefancocora/vaultguard/pkg/listener"
+)
+
+// exit codes of the plan command, a CI job can tell drift apart from failures
+const (
+	planExitError = 1
+	planExitDrift = 2
+)
+
+// vaultguard --config tmp/config.yaml plan
+
+func init() {
+	RootCmd.AddCommand(planCmd)
+}
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show what vaultguard would change on the discovered vault clusters",
+	Long: `Discover the vault clusters and compare their mounts, policies, auth methods
+and audit devices with the config file, without changing anything.
+The vault token is read from ` + listener.PlanTokenEnv + `.
+Exits with 2 when a cluster has drifted from the config and with 1 on errors.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		planCommandParser()
+	},
+}
+
+func planCommandParser() {
+	sConf := listener.DbgConfig{
+		Debug:       debugPtr,
+		DebugConfig: debugConfPtr,
+	}
+	drift, err := listener.Plan(sConf, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to plan: %v\n", err)
+		os.Exit(planExitError)
+	}
+	if drift {
+		os.Exit(planExitDrift)
+	}
+}
@@ -26,6 +26,9 @@ import (
 	"github.com/aws/aws-sdk-go/service/ecs"
 )
 
+// the most ARNs DescribeTasks and DescribeContainerInstances accept in one call
+const describeMaxARNs = 100
+
 var dbgEcsPkg bool
 var dbgEcsConf bool
 var dbgAwsResp bool
@@ -40,6 +43,12 @@ var supportedRegions = []string{
 type AwsEcsInput struct {
 	Region  string
 	Cluster string
+	// Service and Family, when set, restrict the listed tasks to an ECS service or task definition family
+	Service string
+	Family  string
+	// ContainerName and ContainerPort, when set, select the network binding of the vault container
+	ContainerName string
+	ContainerPort int64
 }
 
 // AwsEcsErr returns errors to upstream callers with additional information so that the callers can distinguish between permanent and temporary errors. Callers can distinguish if the error is a standard AWS error or a general error
@@ -78,6 +87,8 @@ type dscInstPort struct {
 type descTaskOutput struct {
 	iarn string
 	port int64
+	// fault is set for a task that is skipped because its vault port can't be told apart
+	fault error
 }
 
 // descECSInstOutput holds the definition of a discovered ECS instance
@@ -126,54 +137,67 @@ func (ec AwsEcsInput) listTaskDef() ([]string, error) {
 	input := &ecs.ListTasksInput{
 		Cluster: aws.String(ec.Cluster),
 	}
+	if ec.Service != "" {
+		input.ServiceName = aws.String(ec.Service)
+	}
+	if ec.Family != "" {
+		input.Family = aws.String(ec.Family)
+	}
 
-	result, err := ecsSvc.ListTasks(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case ecs.ErrCodeServerException:
-				// fmt.Println(ecs.ErrCodeServerException, aerr.Error())
-				return []string{}, aerr
-			case ecs.ErrCodeClientException:
-				// fmt.Println(ecs.ErrCodeClientException, aerr.Error())
-				return []string{}, aerr
-			case ecs.ErrCodeInvalidParameterException:
-				// fmt.Println(ecs.ErrCodeInvalidParameterException, aerr.Error())
-				return []string{}, aerr
-			case ecs.ErrCodeClusterNotFoundException:
-				// fmt.Println(ecs.ErrCodeClusterNotFoundException, aerr.Error())
-				return []string{}, aerr
-			case ecs.ErrCodeServiceNotFoundException:
-				// fmt.Println(ecs.ErrCodeServiceNotFoundException, aerr.Error())
-				return []string{}, aerr
-			default:
-				// fmt.Println(aerr.Error())
-				return []string{}, aerr
+	// step: follow NextToken, a page holds at most 100 task ARNs
+	for {
+		result, err := ecsSvc.ListTasks(input)
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				switch aerr.Code() {
+				case ecs.ErrCodeServerException:
+					// fmt.Println(ecs.ErrCodeServerException, aerr.Error())
+					return []string{}, aerr
+				case ecs.ErrCodeClientException:
+					// fmt.Println(ecs.ErrCodeClientException, aerr.Error())
+					return []string{}, aerr
+				case ecs.ErrCodeInvalidParameterException:
+					// fmt.Println(ecs.ErrCodeInvalidParameterException, aerr.Error())
+					return []string{}, aerr
+				case ecs.ErrCodeClusterNotFoundException:
+					// fmt.Println(ecs.ErrCodeClusterNotFoundException, aerr.Error())
+					return []string{}, aerr
+				case ecs.ErrCodeServiceNotFoundException:
+					// fmt.Println(ecs.ErrCodeServiceNotFoundException, aerr.Error())
+					return []string{}, aerr
+				default:
+					// fmt.Println(aerr.Error())
+					return []string{}, aerr
+				}
+			} else {
+				// Print the error, cast err to awserr.Error to get the Code and
+				// Message from an error.
+				// fmt.Println(err.Error())
+				return []string{}, err
 			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			// fmt.Println(err.Error())
-			return []string{}, err
 		}
-	}
-	if dbgEcsPkg {
-		if dbgAwsResp {
-			var temp []string
-			for i := range result.TaskArns {
-				ts := *result.TaskArns[i]
-				temp = append(temp, ts)
+		if dbgEcsPkg {
+			if dbgAwsResp {
+				var temp []string
+				for i := range result.TaskArns {
+					ts := *result.TaskArns[i]
+					temp = append(temp, ts)
+				}
+				log.Printf("ecs ListTasks: %v", temp)
+			}
+			for res := range result.TaskArns {
+				log.Printf("ecs: discovered task ARN: %#v", *result.TaskArns[res])
+				td = append(td, *result.TaskArns[res])
+			}
+		} else {
+			for res := range result.TaskArns {
+				td = append(td, *result.TaskArns[res])
 			}
-			log.Printf("ecs ListTasks: %v", temp)
-		}
-		for res := range result.TaskArns {
-			log.Printf("ecs: discovered task ARN: %#v", *result.TaskArns[res])
-			td = append(td, *result.TaskArns[res])
 		}
-	} else {
-		for res := range result.TaskArns {
-			td = append(td, *result.TaskArns[res])
+		if result.NextToken == nil {
+			break
 		}
+		input.NextToken = result.NextToken
 	}
 
 	// return task arns
@@ -212,79 +236,89 @@ func (ec AwsEcsInput) describeTasks(td []string) ([]descTaskOutput, []ecs.Failur
 	// step: create a svc session
 	svc := ecs.New(sess, aws.NewConfig().WithRegion(ec.Region))
 
-	// step: prepare inputs
-	var tsk []*string
+	// step: prepare inputs, at most describeMaxARNs tasks per call
+	for _, chunk := range chunkARNs(td, describeMaxARNs) {
+		var tsk []*string
 
-	for i := range td {
-		tsk = append(tsk, &td[i])
-	}
-	input := &ecs.DescribeTasksInput{
-		Cluster: &ec.Cluster,
-		Tasks:   tsk,
-	}
+		for i := range chunk {
+			tsk = append(tsk, &chunk[i])
+		}
+		input := &ecs.DescribeTasksInput{
+			Cluster: &ec.Cluster,
+			Tasks:   tsk,
+		}
 
-	result, err := svc.DescribeTasks(input)
-	// complete failure cases
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case ecs.ErrCodeServerException:
-				// fmt.Println(ecs.ErrCodeServerException, aerr.Error())
-				return []descTaskOutput{}, []ecs.Failure{}, aerr
-			case ecs.ErrCodeClientException:
-				// fmt.Println(ecs.ErrCodeClientException, aerr.Error())
-				return []descTaskOutput{}, []ecs.Failure{}, aerr
-			case ecs.ErrCodeInvalidParameterException:
-				// fmt.Println(ecs.ErrCodeInvalidParameterException, aerr.Error())
-				return []descTaskOutput{}, []ecs.Failure{}, aerr
-			case ecs.ErrCodeClusterNotFoundException:
-				// fmt.Println(ecs.ErrCodeClusterNotFoundException, aerr.Error())
-				return []descTaskOutput{}, []ecs.Failure{}, aerr
-			default:
-				// fmt.Println(aerr.Error())
-				return []descTaskOutput{}, []ecs.Failure{}, aerr
+		result, err := svc.DescribeTasks(input)
+		// complete failure cases
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				switch aerr.Code() {
+				case ecs.ErrCodeServerException:
+					// fmt.Println(ecs.ErrCodeServerException, aerr.Error())
+					return []descTaskOutput{}, []ecs.Failure{}, aerr
+				case ecs.ErrCodeClientException:
+					// fmt.Println(ecs.ErrCodeClientException, aerr.Error())
+					return []descTaskOutput{}, []ecs.Failure{}, aerr
+				case ecs.ErrCodeInvalidParameterException:
+					// fmt.Println(ecs.ErrCodeInvalidParameterException, aerr.Error())
+					return []descTaskOutput{}, []ecs.Failure{}, aerr
+				case ecs.ErrCodeClusterNotFoundException:
+					// fmt.Println(ecs.ErrCodeClusterNotFoundException, aerr.Error())
+					return []descTaskOutput{}, []ecs.Failure{}, aerr
+				default:
+					// fmt.Println(aerr.Error())
+					return []descTaskOutput{}, []ecs.Failure{}, aerr
+				}
+			} else {
+				// Print the error, cast err to awserr.Error to get the Code and
+				// Message from an error.
+				// fmt.Println(err.Error())
+				return []descTaskOutput{}, []ecs.Failure{}, err
 			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			// fmt.Println(err.Error())
-			return []descTaskOutput{}, []ecs.Failure{}, aerr
 		}
-	}
 
-	if dbgEcsPkg {
-		if dbgAwsResp {
-			// extra debug
-			log.Printf("ecs DescribeTasks: %v", result.Tasks)
-		}
-		for res := range result.Tasks {
-			log.Printf("ecs: discovered container instance ARN: %#v", *result.Tasks[res].ContainerInstanceArn)
-			var io descTaskOutput
-			io.iarn = *result.Tasks[res].ContainerInstanceArn
-			for i := range result.Tasks[res].Containers {
-				for j := range result.Tasks[res].Containers[i].NetworkBindings {
-					io.port = *result.Tasks[res].Containers[i].NetworkBindings[j].HostPort
+		if dbgEcsPkg {
+			if dbgAwsResp {
+				// extra debug
+				log.Printf("ecs DescribeTasks: %v", result.Tasks)
+			}
+			for res := range result.Tasks {
+				log.Printf("ecs: discovered container instance ARN: %#v", *result.Tasks[res].ContainerInstanceArn)
+				var io descTaskOutput
+				io.iarn = *result.Tasks[res].ContainerInstanceArn
+				io.port, io.fault = ec.hostPort(result.Tasks[res])
+				if io.fault != nil {
+					ia = append(ia, io)
+					continue
 				}
+				if io.port == 0 {
+					log.Printf("ecs: task %v has no network binding matching container %q port %v, skipping it", aws.StringValue(result.Tasks[res].TaskArn), ec.ContainerName, ec.ContainerPort)
+					continue
+				}
+				ia = append(ia, io)
 			}
-			ia = append(ia, io)
-		}
-	} else {
-		for res := range result.Tasks {
-			var io descTaskOutput
-			io.iarn = *result.Tasks[res].ContainerInstanceArn
-			for i := range result.Tasks[res].Containers {
-				for j := range result.Tasks[res].Containers[i].NetworkBindings {
-					io.port = *result.Tasks[res].Containers[i].NetworkBindings[j].HostPort
+		} else {
+			for res := range result.Tasks {
+				var io descTaskOutput
+				io.iarn = *result.Tasks[res].ContainerInstanceArn
+				io.port, io.fault = ec.hostPort(result.Tasks[res])
+				if io.fault != nil {
+					ia = append(ia, io)
+					continue
+				}
+				if io.port == 0 {
+					continue
 				}
+				ia = append(ia, io)
 			}
-			ia = append(ia, io)
 		}
-	}
 
-	// step: return instance ARNs
-	for f := range result.Failures {
-		iaFailures = append(iaFailures, *result.Failures[f])
+		// step: collect the partial failures of every call
+		for f := range result.Failures {
+			iaFailures = append(iaFailures, *result.Failures[f])
+		}
 	}
+
 	// partial failures test
 	if len(iaFailures) == 0 {
 		return ia, []ecs.Failure{}, nil
@@ -292,6 +326,36 @@ func (ec AwsEcsInput) describeTasks(td []string) ([]descTaskOutput, []ecs.Failur
 	return ia, iaFailures, nil
 }
 
+// hostPort returns the host port of the network binding of a task that matches the container name and port of the input.
+// Without a container port the matching containers must have a single binding, several are an error as the vault one
+// cannot be told apart. It returns 0 when no binding matches.
+func (ec AwsEcsInput) hostPort(t *ecs.Task) (int64, error) {
+
+	var ports []int64
+	for _, c := range t.Containers {
+		if ec.ContainerName != "" && aws.StringValue(c.Name) != ec.ContainerName {
+			continue
+		}
+		for _, nb := range c.NetworkBindings {
+			if ec.ContainerPort != 0 && aws.Int64Value(nb.ContainerPort) != ec.ContainerPort {
+				continue
+			}
+			if nb.HostPort != nil {
+				ports = append(ports, *nb.HostPort)
+			}
+		}
+	}
+
+	switch len(ports) {
+	case 0:
+		return 0, nil
+	case 1:
+		return ports[0], nil
+	}
+	errm := fmt.Sprintf("ecs: task %v has %v network bindings matching container %q port %v, set container_port to select the vault one", aws.StringValue(t.TaskArn), len(ports), ec.ContainerName, ec.ContainerPort)
+	return 0, errors.New(errm)
+}
+
 // describeContInst interogates the DescribeContainerInstances AWS ECS API endpoint to retrieve the container instance ids
 //
 // IN
@@ -328,66 +392,79 @@ func (ec AwsEcsInput) describeContInst(ia []string) ([]descECSInstOutput, []ecs.
 	// step: create a svc session
 	svc := ecs.New(sess, aws.NewConfig().WithRegion(ec.Region))
 
-	// step: prepare inputs
-	var arns []*string
-
+	// step: prepare inputs, several tasks can run on one container instance, at most describeMaxARNs instances per call
+	var uniq []string
+	seen := make(map[string]bool)
 	for i := range ia {
-		arns = append(arns, &ia[i])
+		if !seen[ia[i]] {
+			seen[ia[i]] = true
+			uniq = append(uniq, ia[i])
+		}
 	}
 
-	input := &ecs.DescribeContainerInstancesInput{
-		Cluster:            &ec.Cluster,
-		ContainerInstances: arns,
-	}
+	for _, chunk := range chunkARNs(uniq, describeMaxARNs) {
+		var arns []*string
+
+		for i := range chunk {
+			arns = append(arns, &chunk[i])
+		}
+
+		input := &ecs.DescribeContainerInstancesInput{
+			Cluster:            &ec.Cluster,
+			ContainerInstances: arns,
+		}
 
-	result, err := svc.DescribeContainerInstances(input)
-	// complete failure cases
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case ecs.ErrCodeServerException:
-				// fmt.Println(ecs.ErrCodeServerException, aerr.Error())
-				return []descECSInstOutput{}, []ecs.Failure{}, aerr
-			case ecs.ErrCodeClientException:
-				// fmt.Println(ecs.ErrCodeClientException, aerr.Error())
-				return []descECSInstOutput{}, []ecs.Failure{}, aerr
-			case ecs.ErrCodeInvalidParameterException:
-				// fmt.Println(ecs.ErrCodeInvalidParameterException, aerr.Error())
-				return []descECSInstOutput{}, []ecs.Failure{}, aerr
-			case ecs.ErrCodeClusterNotFoundException:
-				// fmt.Println(ecs.ErrCodeClusterNotFoundException, aerr.Error())
-				return []descECSInstOutput{}, []ecs.Failure{}, aerr
-			default:
-				// fmt.Println(aerr.Error())
-				return []descECSInstOutput{}, []ecs.Failure{}, aerr
+		result, err := svc.DescribeContainerInstances(input)
+		// complete failure cases
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				switch aerr.Code() {
+				case ecs.ErrCodeServerException:
+					// fmt.Println(ecs.ErrCodeServerException, aerr.Error())
+					return []descECSInstOutput{}, []ecs.Failure{}, aerr
+				case ecs.ErrCodeClientException:
+					// fmt.Println(ecs.ErrCodeClientException, aerr.Error())
+					return []descECSInstOutput{}, []ecs.Failure{}, aerr
+				case ecs.ErrCodeInvalidParameterException:
+					// fmt.Println(ecs.ErrCodeInvalidParameterException, aerr.Error())
+					return []descECSInstOutput{}, []ecs.Failure{}, aerr
+				case ecs.ErrCodeClusterNotFoundException:
+					// fmt.Println(ecs.ErrCodeClusterNotFoundException, aerr.Error())
+					return []descECSInstOutput{}, []ecs.Failure{}, aerr
+				default:
+					// fmt.Println(aerr.Error())
+					return []descECSInstOutput{}, []ecs.Failure{}, aerr
+				}
+			} else {
+				// Print the error, cast err to awserr.Error to get the Code and
+				// Message from an error.
+				// fmt.Println(err.Error())
+				return []descECSInstOutput{}, []ecs.Failure{}, err
 			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			// fmt.Println(err.Error())
-			return []descECSInstOutput{}, []ecs.Failure{}, aerr
 		}
-	}
 
-	if dbgEcsPkg {
-		if dbgAwsResp {
-			// extra debug
-			log.Printf("ecs DescribeContainerInstances: %v", result.ContainerInstances)
-		}
-		for res := range result.ContainerInstances {
-			log.Printf("ecs: discovered container instance ID: %#v", *result.ContainerInstances[res].Ec2InstanceId)
-			var t descECSInstOutput
-			t.iid = *result.ContainerInstances[res].Ec2InstanceId
-			t.iarn = *result.ContainerInstances[res].ContainerInstanceArn
-			iid = append(iid, t)
-		}
-		// step: return instance ids
-	} else {
-		for res := range result.ContainerInstances {
-			var t descECSInstOutput
-			t.iid = *result.ContainerInstances[res].Ec2InstanceId
-			t.iarn = *result.ContainerInstances[res].ContainerInstanceArn
-			iid = append(iid, t)
+		if dbgEcsPkg {
+			if dbgAwsResp {
+				// extra debug
+				log.Printf("ecs DescribeContainerInstances: %v", result.ContainerInstances)
+			}
+			for res := range result.ContainerInstances {
+				log.Printf("ecs: discovered container instance ID: %#v", *result.ContainerInstances[res].Ec2InstanceId)
+				var t descECSInstOutput
+				t.iid = *result.ContainerInstances[res].Ec2InstanceId
+				t.iarn = *result.ContainerInstances[res].ContainerInstanceArn
+				iid = append(iid, t)
+			}
+		} else {
+			for res := range result.ContainerInstances {
+				var t descECSInstOutput
+				t.iid = *result.ContainerInstances[res].Ec2InstanceId
+				t.iarn = *result.ContainerInstances[res].ContainerInstanceArn
+				iid = append(iid, t)
+			}
+		}
+		for f := range result.Failures {
+			iidFailures = append(iidFailures, *result.Failures[f])
 		}
 	}
 
@@ -426,6 +503,11 @@ func (ec AwsEcsInput) describeEC2Inst(iid []string) ([]descEC2InstOutput, error)
 		return []descEC2InstOutput{}, errors.New(errm)
 	}
 
+	// step: without instance ids DescribeInstances would return every running instance of the region
+	if len(iid) == 0 {
+		return []descEC2InstOutput{}, nil
+	}
+
 	// step: create a svc session
 	svc := ec2.New(sess, aws.NewConfig().WithRegion(ec.Region))
 
@@ -454,41 +536,55 @@ func (ec AwsEcsInput) describeEC2Inst(iid []string) ([]descEC2InstOutput, error)
 		InstanceIds: ii,
 	}
 
-	result, err := svc.DescribeInstances(input)
+	// step: follow NextToken until every reservation is read
+	for {
+		result, err := svc.DescribeInstances(input)
 
-	// complete failure cases
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				// fmt.Println(aerr.Error())
-				return []descEC2InstOutput{}, aerr
+		// complete failure cases
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				switch aerr.Code() {
+				default:
+					// fmt.Println(aerr.Error())
+					return []descEC2InstOutput{}, aerr
+				}
+			} else {
+				// Print the error, cast err to awserr.Error to get the Code and
+				// Message from an error.
+				// fmt.Println(err.Error())
+				return []descEC2InstOutput{}, err
 			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			// fmt.Println(err.Error())
-			return []descEC2InstOutput{}, aerr
 		}
-	}
 
-	if dbgEcsPkg {
-		if dbgAwsResp {
-			// extra debug
-			log.Printf("ec2 DescribeInstances: %v", result.Reservations)
-		}
-		for res := range result.Reservations {
-			for i := range result.Reservations[res].Instances {
-				for j := range result.Reservations[res].Instances[i].NetworkInterfaces {
-					if dbgAwsResp {
-						// extra debug
-						log.Printf("ecs: discovered container instance private ips: %#v", *result.Reservations[res].Instances[i].NetworkInterfaces[j].PrivateIpAddresses[0])
-						var t descEC2InstOutput
-						t.iprivip = *result.Reservations[res].Instances[i].NetworkInterfaces[j].PrivateIpAddresses[0].PrivateIpAddress
-						t.iid = *result.Reservations[res].Instances[i].InstanceId
-						iprivip = append(iprivip, t)
-					} else {
-						log.Printf("ecs: discovered container instance private ips: %#v", *result.Reservations[res].Instances[i].NetworkInterfaces[j].PrivateIpAddresses[0].PrivateIpAddress)
+		if dbgEcsPkg {
+			if dbgAwsResp {
+				// extra debug
+				log.Printf("ec2 DescribeInstances: %v", result.Reservations)
+			}
+			for res := range result.Reservations {
+				for i := range result.Reservations[res].Instances {
+					for j := range result.Reservations[res].Instances[i].NetworkInterfaces {
+						if dbgAwsResp {
+							// extra debug
+							log.Printf("ecs: discovered container instance private ips: %#v", *result.Reservations[res].Instances[i].NetworkInterfaces[j].PrivateIpAddresses[0])
+							var t descEC2InstOutput
+							t.iprivip = *result.Reservations[res].Instances[i].NetworkInterfaces[j].PrivateIpAddresses[0].PrivateIpAddress
+							t.iid = *result.Reservations[res].Instances[i].InstanceId
+							iprivip = append(iprivip, t)
+						} else {
+							log.Printf("ecs: discovered container instance private ips: %#v", *result.Reservations[res].Instances[i].NetworkInterfaces[j].PrivateIpAddresses[0].PrivateIpAddress)
+							var t descEC2InstOutput
+							t.iprivip = *result.Reservations[res].Instances[i].NetworkInterfaces[j].PrivateIpAddresses[0].PrivateIpAddress
+							t.iid = *result.Reservations[res].Instances[i].InstanceId
+							iprivip = append(iprivip, t)
+						}
+					}
+				}
+			}
+		} else {
+			for res := range result.Reservations {
+				for i := range result.Reservations[res].Instances {
+					for j := range result.Reservations[res].Instances[i].NetworkInterfaces {
 						var t descEC2InstOutput
 						t.iprivip = *result.Reservations[res].Instances[i].NetworkInterfaces[j].PrivateIpAddresses[0].PrivateIpAddress
 						t.iid = *result.Reservations[res].Instances[i].InstanceId
@@ -497,23 +593,31 @@ func (ec AwsEcsInput) describeEC2Inst(iid []string) ([]descEC2InstOutput, error)
 				}
 			}
 		}
-	} else {
-		for res := range result.Reservations {
-			for i := range result.Reservations[res].Instances {
-				for j := range result.Reservations[res].Instances[i].NetworkInterfaces {
-					var t descEC2InstOutput
-					t.iprivip = *result.Reservations[res].Instances[i].NetworkInterfaces[j].PrivateIpAddresses[0].PrivateIpAddress
-					t.iid = *result.Reservations[res].Instances[i].InstanceId
-					iprivip = append(iprivip, t)
-				}
-			}
+		if result.NextToken == nil {
+			break
 		}
+		input.NextToken = result.NextToken
 	}
 
 	// step: return instance priv ips
 	return iprivip, nil
 }
 
+// chunkARNs splits ARNs into chunks of at most n
+func chunkARNs(arns []string, n int) [][]string {
+
+	var chunks [][]string
+	for len(arns) > n {
+		chunks = append(chunks, arns[:n])
+		arns = arns[n:]
+	}
+	if len(arns) != 0 {
+		chunks = append(chunks, arns)
+	}
+
+	return chunks
+}
+
 // Discover is used as a way to discover vault endpoints in ECS starting from a cluster name and region
 //
 // IN
@@ -553,9 +657,13 @@ func Discover(ec []AwsEcsInput) []AwsEcsOutput {
 			log.Printf("ecs: partial failures when running DescribeTasks(): %v", iaf)
 		}
 
-		// step: get instance ids
+		// step: get instance ids, a task with ambiguous bindings is skipped on its own rather than failing the cluster
 		var tia []string
 		for i := range ia {
+			if ia[i].fault != nil {
+				dve.Fault = append(dve.Fault, ia[i].fault)
+				continue
+			}
 			tia = append(tia, ia[i].iarn)
 		}
 		iid, iipsf, err := ec[i].describeContInst(tia)
@@ -584,7 +692,7 @@ func Discover(ec []AwsEcsInput) []AwsEcsOutput {
 			for j := range iid {
 				if iprivi[i].iid == iid[j].iid {
 					for k := range ia {
-						if iid[j].iarn == ia[k].iarn {
+						if ia[k].fault == nil && iid[j].iarn == ia[k].iarn {
 							ts.Port = strconv.FormatInt(ia[k].port, 10)
 							dve.VaultServers = append(dve.VaultServers, ts)
 						}
@@ -0,0 +1,108 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discover
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	ecs "github.com/stefancocora/vaultguard/pkg/discover/aws"
+)
+
+var dbgDiscoverPkg bool
+
+// Node is a single vault node found by a discoverer
+type Node struct {
+	// Cluster is the name of the vault cluster the node belongs to
+	Cluster string
+	// Address is the vault API address of the node, eg https://10.0.0.1:8200
+	Address string
+	// TLSServerName and CACert override the TLS settings of the endpoint for this node when set
+	TLSServerName string
+	CACert        string
+}
+
+// Result holds the nodes discovered for a single cluster, or why they could not be discovered
+type Result struct {
+	Cluster string
+	Nodes   []Node
+	Fault   []error
+}
+
+// Discoverer finds the vault nodes of the endpoints of one type
+type Discoverer interface {
+	// Validate checks the specs of an endpoint, it is called when the config is loaded
+	Validate(specs []Spec) error
+	// Discover returns the nodes of every spec, one result per cluster
+	Discover(specs []Spec) []Result
+}
+
+// registry maps an endpoint type to its discoverer
+var registry = map[string]Discoverer{
+	TypeECS: ecsDiscoverer{},
+	TypeURL: urlDiscoverer{},
+	TypeK8s: k8sDiscoverer{},
+}
+
+// Lookup returns the discoverer of an endpoint type
+func Lookup(typ string) (Discoverer, error) {
+
+	d, ok := registry[typ]
+	if !ok {
+		errm := fmt.Sprintf("discover: unsupported endpoint type %q, supported types are %v", typ, strings.Join(Types(), ", "))
+		return nil, errors.New(errm)
+	}
+
+	return d, nil
+}
+
+// Types returns the supported endpoint types
+func Types() []string {
+
+	var types []string
+	for t := range registry {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	return types
+}
+
+// Validate checks that an endpoint type is supported and that its specs are complete
+func Validate(typ string, specs []Spec) error {
+
+	d, err := Lookup(typ)
+	if err != nil {
+		return err
+	}
+	if len(specs) == 0 {
+		return errors.New("discover: an endpoint needs at least one spec")
+	}
+	for i, s := range specs {
+		if s.Cluster == "" {
+			errm := fmt.Sprintf("discover: spec %v needs a cluster name", i)
+			return errors.New(errm)
+		}
+	}
+
+	return d.Validate(specs)
+}
+
+// PropagateDebug propagates the debug flags into this pkg and the providers
+func PropagateDebug(dbg bool, confDbg bool) {
+	dbgDiscoverPkg = dbg
+	ecs.PropagateDebug(dbg, confDbg)
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discover
+
+import (
+	"errors"
+	"fmt"
+
+	ecs "github.com/stefancocora/vaultguard/pkg/discover/aws"
+)
+
+// ecsDiscoverer finds the vault tasks of ECS clusters
+type ecsDiscoverer struct{}
+
+func (ecsDiscoverer) Validate(specs []Spec) error {
+	for _, s := range specs {
+		es := s.Ecs()
+		if es.Region == "" {
+			errm := fmt.Sprintf("discover: ecs cluster %v needs a region", s.Cluster)
+			return errors.New(errm)
+		}
+		if es.ContainerPort < 0 || es.ContainerPort > 65535 {
+			errm := fmt.Sprintf("discover: ecs cluster %v has an invalid container_port %v", s.Cluster, es.ContainerPort)
+			return errors.New(errm)
+		}
+	}
+	return nil
+}
+
+func (ecsDiscoverer) Discover(specs []Spec) []Result {
+
+	var in []ecs.AwsEcsInput
+	for _, s := range specs {
+		es := s.Ecs()
+		in = append(in, ecs.AwsEcsInput{
+			Region:        es.Region,
+			Cluster:       es.Cluster,
+			Service:       es.Service,
+			Family:        es.Family,
+			ContainerName: es.ContainerName,
+			ContainerPort: es.ContainerPort,
+		})
+	}
+
+	var res []Result
+	for _, o := range ecs.Discover(in) {
+		r := Result{Cluster: o.Cluster, Fault: o.Fault}
+		for _, v := range o.VaultServers {
+			r.Nodes = append(r.Nodes, Node{
+				Cluster: o.Cluster,
+				Address: fmt.Sprintf("https://%v:%v", v.IP, v.Port),
+			})
+		}
+		res = append(res, r)
+	}
+
+	return res
+}
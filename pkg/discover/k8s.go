@@ -0,0 +1,456 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discover
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// how long a single call to the kubernetes API may take
+const k8sTimeout = 10 * time.Second
+
+// serviceAccountDir holds the token, CA and namespace of the pod service account,
+// it is a variable so that in-cluster auth can be pointed somewhere else
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// k8sDiscoverer finds the ready pods behind a kubernetes service through the Endpoints API
+type k8sDiscoverer struct{}
+
+func (k8sDiscoverer) Validate(specs []Spec) error {
+
+	for _, s := range specs {
+		ks := s.K8s()
+		if ks.Service == "" {
+			errm := fmt.Sprintf("discover: k8s cluster %v needs a service", s.Cluster)
+			return errors.New(errm)
+		}
+		if ks.Kubeconfig == "" {
+			if ks.Context != "" {
+				errm := fmt.Sprintf("discover: k8s cluster %v sets a context without a kubeconfig", s.Cluster)
+				return errors.New(errm)
+			}
+			continue
+		}
+		// step: in-cluster settings only exist at runtime, a kubeconfig can be checked now
+		if _, err := kubeconfigAPI(ks); err != nil {
+			errm := fmt.Sprintf("discover: k8s cluster %v: %v", s.Cluster, err)
+			return errors.New(errm)
+		}
+	}
+
+	return nil
+}
+
+func (k8sDiscoverer) Discover(specs []Spec) []Result {
+
+	var res []Result
+	for _, s := range specs {
+		r := Result{Cluster: s.Cluster}
+		nodes, err := k8sNodes(s.Cluster, s.K8s())
+		if err != nil {
+			r.Fault = append(r.Fault, err)
+		}
+		r.Nodes = nodes
+		if dbgDiscoverPkg {
+			log.Printf("k8s: discovered nodes of cluster %v: %v", s.Cluster, r.Nodes)
+		}
+		res = append(res, r)
+	}
+
+	return res
+}
+
+// k8sAPI is a minimal client of the kubernetes API server
+type k8sAPI struct {
+	server string
+	// namespace is the default namespace of the credentials
+	namespace string
+	token     string
+	username  string
+	password  string
+	hc        *http.Client
+}
+
+// newK8sAPI returns a client for the API server of a spec, from its kubeconfig or from the pod service account
+func newK8sAPI(ks K8sSpec) (*k8sAPI, error) {
+
+	if ks.Kubeconfig != "" {
+		return kubeconfigAPI(ks)
+	}
+
+	return inClusterAPI()
+}
+
+// inClusterAPI returns a client authenticated with the service account of the pod vaultguard runs in
+func inClusterAPI() (*k8sAPI, error) {
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("k8s: not running in a kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set and no kubeconfig is configured")
+	}
+
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		errm := fmt.Sprintf("k8s: unable to read the service account token: %v", err)
+		return nil, errors.New(errm)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		errm := fmt.Sprintf("k8s: unable to read the service account CA: %v", err)
+		return nil, errors.New(errm)
+	}
+	tlsc, err := k8sTLSConfig(ca, false)
+	if err != nil {
+		return nil, err
+	}
+	ns := "default"
+	if b, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil {
+		ns = strings.TrimSpace(string(b))
+	}
+
+	a := &k8sAPI{
+		server:    "https://" + net.JoinHostPort(host, port),
+		namespace: ns,
+		token:     strings.TrimSpace(string(token)),
+		hc:        k8sHTTPClient(tlsc),
+	}
+
+	return a, nil
+}
+
+// kubeconfig is the part of a kubeconfig file the k8s discoverer understands
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+			TLSServerName            string `yaml:"tls-server-name"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string      `yaml:"token"`
+			TokenFile             string      `yaml:"tokenFile"`
+			ClientCertificate     string      `yaml:"client-certificate"`
+			ClientCertificateData string      `yaml:"client-certificate-data"`
+			ClientKey             string      `yaml:"client-key"`
+			ClientKeyData         string      `yaml:"client-key-data"`
+			Username              string      `yaml:"username"`
+			Password              string      `yaml:"password"`
+			Exec                  interface{} `yaml:"exec"`
+			AuthProvider          interface{} `yaml:"auth-provider"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// kubeconfigAPI returns a client for the cluster and user of the selected kubeconfig context
+func kubeconfigAPI(ks K8sSpec) (*k8sAPI, error) {
+
+	b, err := ioutil.ReadFile(ks.Kubeconfig)
+	if err != nil {
+		errm := fmt.Sprintf("k8s: unable to read kubeconfig: %v", err)
+		return nil, errors.New(errm)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(b, &kc); err != nil {
+		errm := fmt.Sprintf("k8s: unable to parse kubeconfig %v: %v", ks.Kubeconfig, err)
+		return nil, errors.New(errm)
+	}
+	// step: relative paths in a kubeconfig are relative to the file itself
+	dir := filepath.Dir(ks.Kubeconfig)
+	read := func(path, data string) ([]byte, error) {
+		if data != "" {
+			return base64.StdEncoding.DecodeString(data)
+		}
+		if path == "" {
+			return nil, nil
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		return ioutil.ReadFile(path)
+	}
+
+	name := ks.Context
+	if name == "" {
+		name = kc.CurrentContext
+	}
+	if name == "" {
+		errm := fmt.Sprintf("k8s: kubeconfig %v has no current context and the spec selects none", ks.Kubeconfig)
+		return nil, errors.New(errm)
+	}
+	ctxi := -1
+	for i, c := range kc.Contexts {
+		if c.Name == name {
+			ctxi = i
+		}
+	}
+	if ctxi < 0 {
+		errm := fmt.Sprintf("k8s: kubeconfig %v has no context %v", ks.Kubeconfig, name)
+		return nil, errors.New(errm)
+	}
+	kctx := kc.Contexts[ctxi].Context
+
+	a := &k8sAPI{namespace: kctx.Namespace}
+	if a.namespace == "" {
+		a.namespace = "default"
+	}
+
+	found := false
+	var tlsc *tls.Config
+	for _, c := range kc.Clusters {
+		if c.Name != kctx.Cluster {
+			continue
+		}
+		found = true
+		if _, err := url.Parse(c.Cluster.Server); err != nil || c.Cluster.Server == "" {
+			errm := fmt.Sprintf("k8s: kubeconfig cluster %v has no valid server", c.Name)
+			return nil, errors.New(errm)
+		}
+		a.server = strings.TrimSuffix(c.Cluster.Server, "/")
+		ca, err := read(c.Cluster.CertificateAuthority, c.Cluster.CertificateAuthorityData)
+		if err != nil {
+			errm := fmt.Sprintf("k8s: unable to read the CA of kubeconfig cluster %v: %v", c.Name, err)
+			return nil, errors.New(errm)
+		}
+		tlsc, err = k8sTLSConfig(ca, c.Cluster.InsecureSkipTLSVerify)
+		if err != nil {
+			return nil, err
+		}
+		tlsc.ServerName = c.Cluster.TLSServerName
+	}
+	if !found {
+		errm := fmt.Sprintf("k8s: kubeconfig %v has no cluster %v", ks.Kubeconfig, kctx.Cluster)
+		return nil, errors.New(errm)
+	}
+
+	userFound := false
+	for _, u := range kc.Users {
+		if u.Name != kctx.User {
+			continue
+		}
+		userFound = true
+		if u.User.Exec != nil || u.User.AuthProvider != nil {
+			errm := fmt.Sprintf("k8s: kubeconfig user %v uses an exec or auth provider plugin, which is not supported", u.Name)
+			return nil, errors.New(errm)
+		}
+		a.token = u.User.Token
+		if u.User.TokenFile != "" {
+			t, err := read(u.User.TokenFile, "")
+			if err != nil {
+				errm := fmt.Sprintf("k8s: unable to read the token of kubeconfig user %v: %v", u.Name, err)
+				return nil, errors.New(errm)
+			}
+			a.token = strings.TrimSpace(string(t))
+		}
+		a.username, a.password = u.User.Username, u.User.Password
+		cert, err := read(u.User.ClientCertificate, u.User.ClientCertificateData)
+		if err != nil {
+			errm := fmt.Sprintf("k8s: unable to read the client certificate of kubeconfig user %v: %v", u.Name, err)
+			return nil, errors.New(errm)
+		}
+		key, err := read(u.User.ClientKey, u.User.ClientKeyData)
+		if err != nil {
+			errm := fmt.Sprintf("k8s: unable to read the client key of kubeconfig user %v: %v", u.Name, err)
+			return nil, errors.New(errm)
+		}
+		if len(cert) != 0 || len(key) != 0 {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				errm := fmt.Sprintf("k8s: invalid client certificate of kubeconfig user %v: %v", u.Name, err)
+				return nil, errors.New(errm)
+			}
+			tlsc.Certificates = []tls.Certificate{pair}
+		}
+	}
+	// step: a missing user would otherwise send every request unauthenticated
+	if kctx.User != "" && !userFound {
+		errm := fmt.Sprintf("k8s: kubeconfig %v has no user %v", ks.Kubeconfig, kctx.User)
+		return nil, errors.New(errm)
+	}
+	a.hc = k8sHTTPClient(tlsc)
+
+	return a, nil
+}
+
+// k8sTLSConfig trusts the given CA bundle, or the system roots without one
+func k8sTLSConfig(ca []byte, insecure bool) (*tls.Config, error) {
+
+	tlsc := &tls.Config{InsecureSkipVerify: insecure}
+	if len(ca) != 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("k8s: no PEM certificates found in the API server CA")
+		}
+		tlsc.RootCAs = pool
+	}
+
+	return tlsc, nil
+}
+
+func k8sHTTPClient(tlsc *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout: k8sTimeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsc,
+			TLSHandshakeTimeout: k8sTimeout,
+		},
+	}
+}
+
+// get decodes the JSON object at an API path into out
+func (a *k8sAPI) get(path string, out interface{}) error {
+
+	req, err := http.NewRequest(http.MethodGet, a.server+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	} else if a.username != "" {
+		req.SetBasicAuth(a.username, a.password)
+	}
+
+	resp, err := a.hc.Do(req)
+	if err != nil {
+		errm := fmt.Sprintf("k8s: GET %v failed: %v", path, err)
+		return errors.New(errm)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		errm := fmt.Sprintf("k8s: unable to read the response of GET %v: %v", path, err)
+		return errors.New(errm)
+	}
+	if resp.StatusCode != http.StatusOK {
+		errm := fmt.Sprintf("k8s: GET %v returned %v: %v", path, resp.Status, strings.TrimSpace(string(body)))
+		return errors.New(errm)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		errm := fmt.Sprintf("k8s: unable to decode the response of GET %v: %v", path, err)
+		return errors.New(errm)
+	}
+
+	return nil
+}
+
+// k8sEndpoints is the part of a v1 Endpoints object the k8s discoverer needs
+type k8sEndpoints struct {
+	Subsets []struct {
+		// Addresses are the ready pods, NotReadyAddresses are not decoded so that they are never used
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name     string `json:"name"`
+			Port     int    `json:"port"`
+			Protocol string `json:"protocol"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// k8sNodes returns one node per ready pod address of the service of a spec
+func k8sNodes(cluster string, ks K8sSpec) ([]Node, error) {
+
+	a, err := newK8sAPI(ks)
+	if err != nil {
+		return nil, err
+	}
+	ns := ks.Namespace
+	if ns == "" {
+		ns = a.namespace
+	}
+
+	var eps k8sEndpoints
+	path := "/api/v1/namespaces/" + url.PathEscape(ns) + "/endpoints/" + url.PathEscape(ks.Service)
+	if err := a.get(path, &eps); err != nil {
+		return nil, err
+	}
+
+	// step: the pods are reached by IP, their certificates are verified against the service DNS name
+	sn := ks.TLSServerName
+	if sn == "" {
+		sn = ks.Service + "." + ns + ".svc"
+	}
+	var nodes []Node
+	var faults []string
+	for _, ss := range eps.Subsets {
+		port := 0
+		for _, p := range ss.Ports {
+			if p.Protocol != "" && p.Protocol != "TCP" {
+				continue
+			}
+			if ks.PortName != "" && p.Name != ks.PortName {
+				continue
+			}
+			if port != 0 {
+				faults = append(faults, "the service has more than one port, set port_name")
+				port = 0
+				break
+			}
+			port = p.Port
+		}
+		if port == 0 {
+			if len(ss.Addresses) != 0 && ks.PortName != "" {
+				faults = append(faults, "no port named "+ks.PortName)
+			}
+			continue
+		}
+		for _, addr := range ss.Addresses {
+			nodes = append(nodes, Node{
+				Cluster:       cluster,
+				Address:       "https://" + net.JoinHostPort(addr.IP, strconv.Itoa(port)),
+				TLSServerName: sn,
+			})
+		}
+	}
+	if len(nodes) == 0 && len(faults) != 0 {
+		errm := fmt.Sprintf("k8s: service %v/%v: %v", ns, ks.Service, faults[0])
+		return nil, errors.New(errm)
+	}
+
+	return nodes, nil
+}
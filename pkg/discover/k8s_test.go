@@ -0,0 +1,251 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discover
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// endpoints has two ready pods, one pod that is not ready and two named ports
+const endpoints = `{
+  "kind": "Endpoints",
+  "apiVersion": "v1",
+  "metadata": {"name": "vault", "namespace": "vault"},
+  "subsets": [{
+    "addresses": [{"ip": "10.0.0.1"}, {"ip": "10.0.0.2"}],
+    "notReadyAddresses": [{"ip": "10.0.0.9"}],
+    "ports": [
+      {"name": "api", "port": 8200, "protocol": "TCP"},
+      {"name": "cluster", "port": 8201, "protocol": "TCP"}
+    ]
+  }]
+}`
+
+// fakeAPIServer serves the vault Endpoints object to requests bearing token
+func fakeAPIServer(token string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"kind":"Status","status":"Failure","reason":"Unauthorized","code":401}`)
+			return
+		}
+		if r.Method != http.MethodGet || r.URL.Path != "/api/v1/namespaces/vault/endpoints/vault" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, endpoints)
+	}))
+}
+
+// caPEM returns the certificate of a TLS test server in PEM
+func caPEM(srv *httptest.Server) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+}
+
+func writeFile(t *testing.T, path string, b []byte) {
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestK8sDiscover(t *testing.T) {
+
+	srv := fakeAPIServer("sa-token")
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// step: a service account directory for in-cluster auth
+	sa := filepath.Join(dir, "serviceaccount")
+	if err := os.Mkdir(sa, 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(sa, "token"), []byte("sa-token\n"))
+	writeFile(t, filepath.Join(sa, "ca.crt"), caPEM(srv))
+	writeFile(t, filepath.Join(sa, "namespace"), []byte("vault"))
+	defer func(d string) { serviceAccountDir = d }(serviceAccountDir)
+	serviceAccountDir = sa
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"KUBERNETES_SERVICE_HOST": host, "KUBERNETES_SERVICE_PORT": port} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	// step: a kubeconfig with a context for the fake API server and one with the wrong credentials
+	writeFile(t, filepath.Join(dir, "ca.crt"), caPEM(srv))
+	writeFile(t, filepath.Join(dir, "token"), []byte("sa-token\n"))
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	writeFile(t, kubeconfig, []byte(`apiVersion: v1
+kind: Config
+current-context: fake
+contexts:
+- name: fake
+  context:
+    cluster: fake
+    user: vaultguard
+    namespace: vault
+- name: anonymous
+  context:
+    cluster: fake
+    user: anonymous
+    namespace: vault
+- name: unknown-user
+  context:
+    cluster: fake
+    user: nobody
+    namespace: vault
+clusters:
+- name: fake
+  cluster:
+    server: "`+srv.URL+`"
+    certificate-authority: ca.crt
+users:
+- name: vaultguard
+  user:
+    tokenFile: token
+- name: anonymous
+  user: {}
+`))
+
+	node := func(addr string) Node {
+		return Node{Cluster: "vault", Address: addr, TLSServerName: "vault.vault.svc"}
+	}
+
+	tests := []struct {
+		name  string
+		spec  Spec
+		nodes []Node
+		fault string
+	}{
+		{
+			name:  "in-cluster named port",
+			spec:  Spec{Cluster: "vault", Service: "vault", PortName: "api"},
+			nodes: []Node{node("https://10.0.0.1:8200"), node("https://10.0.0.2:8200")},
+		},
+		{
+			name:  "in-cluster other named port",
+			spec:  Spec{Cluster: "vault", Namespace: "vault", Service: "vault", PortName: "cluster"},
+			nodes: []Node{node("https://10.0.0.1:8201"), node("https://10.0.0.2:8201")},
+		},
+		{
+			name: "in-cluster tls server name",
+			spec: Spec{Cluster: "vault", Service: "vault", PortName: "api", TLSServerName: "vault.example.com"},
+			nodes: []Node{
+				{Cluster: "vault", Address: "https://10.0.0.1:8200", TLSServerName: "vault.example.com"},
+				{Cluster: "vault", Address: "https://10.0.0.2:8200", TLSServerName: "vault.example.com"},
+			},
+		},
+		{
+			name:  "in-cluster ambiguous port",
+			spec:  Spec{Cluster: "vault", Service: "vault"},
+			fault: "more than one port",
+		},
+		{
+			name:  "in-cluster unknown port name",
+			spec:  Spec{Cluster: "vault", Service: "vault", PortName: "http"},
+			fault: "no port named http",
+		},
+		{
+			name:  "kubeconfig current context",
+			spec:  Spec{Cluster: "vault", Service: "vault", Kubeconfig: kubeconfig, PortName: "api"},
+			nodes: []Node{node("https://10.0.0.1:8200"), node("https://10.0.0.2:8200")},
+		},
+		{
+			name:  "kubeconfig context without credentials",
+			spec:  Spec{Cluster: "vault", Service: "vault", Kubeconfig: kubeconfig, Context: "anonymous", PortName: "api"},
+			fault: "401",
+		},
+		{
+			name:  "kubeconfig context with an unknown user",
+			spec:  Spec{Cluster: "vault", Service: "vault", Kubeconfig: kubeconfig, Context: "unknown-user", PortName: "api"},
+			fault: "has no user nobody",
+		},
+		{
+			name:  "missing service",
+			spec:  Spec{Cluster: "vault", Namespace: "vault", Service: "consul", PortName: "api"},
+			fault: "404",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(TypeK8s, []Spec{tt.spec}); err != nil {
+				// step: a broken kubeconfig is already rejected when the config is validated
+				if tt.fault != "" && strings.Contains(err.Error(), tt.fault) {
+					return
+				}
+				t.Fatalf("Validate: %v", err)
+			}
+			res := k8sDiscoverer{}.Discover([]Spec{tt.spec})
+			if len(res) != 1 {
+				t.Fatalf("Discover returned %v results, expected 1", len(res))
+			}
+			r := res[0]
+			if tt.fault != "" {
+				if len(r.Fault) != 1 || !strings.Contains(r.Fault[0].Error(), tt.fault) {
+					t.Fatalf("Discover returned the faults %v, expected one containing %q", r.Fault, tt.fault)
+				}
+				return
+			}
+			if len(r.Fault) != 0 {
+				t.Fatalf("Discover returned the faults %v", r.Fault)
+			}
+			if !reflect.DeepEqual(r.Nodes, tt.nodes) {
+				t.Errorf("Discover returned the nodes %v, expected %v", r.Nodes, tt.nodes)
+			}
+		})
+	}
+}
+
+func TestK8sValidate(t *testing.T) {
+
+	tests := []struct {
+		name string
+		spec Spec
+	}{
+		{name: "no service", spec: Spec{Cluster: "vault"}},
+		{name: "context without kubeconfig", spec: Spec{Cluster: "vault", Service: "vault", Context: "fake"}},
+		{name: "missing kubeconfig", spec: Spec{Cluster: "vault", Service: "vault", Kubeconfig: "/nonexistent/kubeconfig"}},
+	}
+
+	for _, tt := range tests {
+		if err := Validate(TypeK8s, []Spec{tt.spec}); err == nil {
+			t.Errorf("%v: Validate accepted %+v", tt.name, tt.spec)
+		}
+	}
+}
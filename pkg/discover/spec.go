@@ -0,0 +1,115 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discover
+
+// supported endpoint types
+const (
+	TypeECS = "ecs"
+	TypeURL = "url"
+	TypeK8s = "k8s"
+)
+
+// Spec contains the overall Endpoint definition, the fields the endpoint type doesn't use are ignored
+type Spec struct {
+	// Cluster names the vault cluster, for ecs it is also the ECS cluster the vault tasks run in
+	Cluster string `yaml:"cluster,omitempty" json:"cluster,omitempty"`
+	// ecs, Service is shared with k8s
+	Region        string `yaml:"region,omitempty" json:"region,omitempty"`
+	Family        string `yaml:"family,omitempty" json:"family,omitempty"`
+	ContainerName string `yaml:"container_name,omitempty" json:"container_name,omitempty"`
+	ContainerPort int64  `yaml:"container_port,omitempty" json:"container_port,omitempty"`
+	// url, URL is a shorthand for a single entry of URLs
+	URL  string    `yaml:"url,omitempty" json:"url,omitempty"`
+	URLs []URLSpec `yaml:"urls,omitempty" json:"urls,omitempty"`
+	// k8s
+	Namespace  string `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	Service    string `yaml:"service,omitempty" json:"service,omitempty"`
+	Kubeconfig string `yaml:"kubeconfig,omitempty" json:"kubeconfig,omitempty"`
+	Context    string `yaml:"context,omitempty" json:"context,omitempty"`
+	PortName   string `yaml:"port_name,omitempty" json:"port_name,omitempty"`
+	// TLSServerName is the name the pod certificates are verified against, it defaults to <service>.<namespace>.svc
+	TLSServerName string `yaml:"tls_server_name,omitempty" json:"tls_server_name,omitempty"`
+}
+
+// EcsSpec is the Endpoint that holds the definition of the requirements to get to a vault service running in AWS ECS
+type EcsSpec struct {
+	Cluster string `yaml:"cluster" json:"cluster"`
+	Region  string `yaml:"region" json:"region"`
+	// Service and Family restrict discovery to the tasks of an ECS service or task definition family
+	Service string `yaml:"service,omitempty" json:"service,omitempty"`
+	Family  string `yaml:"family,omitempty" json:"family,omitempty"`
+	// ContainerName and ContainerPort select the network binding of the vault container, ContainerPort is required when a task has several
+	ContainerName string `yaml:"container_name,omitempty" json:"container_name,omitempty"`
+	ContainerPort int64  `yaml:"container_port,omitempty" json:"container_port,omitempty"`
+}
+
+// URLSpec is the Endpoint that  holds the definition of the requirements to get to a vault service running at a defined URL
+type URLSpec struct {
+	URL string `yaml:"url" json:"url"`
+	// TLSServerName is the name the node certificate is verified against, it defaults to the URL host
+	TLSServerName string `yaml:"tls_server_name,omitempty" json:"tls_server_name,omitempty"`
+	// CACert replaces the CA bundle of the endpoint for this URL
+	CACert string `yaml:"ca_cert,omitempty" json:"ca_cert,omitempty"`
+	// Resolve expands the URL host into one node per A record
+	Resolve bool `yaml:"resolve,omitempty" json:"resolve,omitempty"`
+}
+
+// K8sSpec is the Endpoint that  holds the definition of the requirements to get to a vault service running in a kubernetes cluster
+type K8sSpec struct {
+	Namespace string `yaml:"namespace" json:"namespace"`
+	Service   string `yaml:"service" json:"service"`
+	// Kubeconfig is the kubeconfig file to reach the API server with, in-cluster service account auth is used without it
+	Kubeconfig string `yaml:"kubeconfig,omitempty" json:"kubeconfig,omitempty"`
+	// Context selects a kubeconfig context other than the current one
+	Context string `yaml:"context,omitempty" json:"context,omitempty"`
+	// PortName selects the service port when the service has more than one
+	PortName string `yaml:"port_name,omitempty" json:"port_name,omitempty"`
+	// TLSServerName is the name the pod certificates are verified against, it defaults to <service>.<namespace>.svc
+	TLSServerName string `yaml:"tls_server_name,omitempty" json:"tls_server_name,omitempty"`
+}
+
+// Ecs returns the ecs part of the spec
+func (s Spec) Ecs() EcsSpec {
+	return EcsSpec{
+		Cluster:       s.Cluster,
+		Region:        s.Region,
+		Service:       s.Service,
+		Family:        s.Family,
+		ContainerName: s.ContainerName,
+		ContainerPort: s.ContainerPort,
+	}
+}
+
+// K8s returns the k8s part of the spec
+func (s Spec) K8s() K8sSpec {
+	return K8sSpec{
+		Namespace:     s.Namespace,
+		Service:       s.Service,
+		Kubeconfig:    s.Kubeconfig,
+		Context:       s.Context,
+		PortName:      s.PortName,
+		TLSServerName: s.TLSServerName,
+	}
+}
+
+// URLSpecs returns the url part of the spec, URL first
+func (s Spec) URLSpecs() []URLSpec {
+
+	var us []URLSpec
+	if s.URL != "" {
+		us = append(us, URLSpec{URL: s.URL})
+	}
+
+	return append(us, s.URLs...)
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"time"
+)
+
+// how long resolving the host of a single URL may take
+const resolveTimeout = 10 * time.Second
+
+// lookupIPAddr resolves a host name, it is a variable so that the resolver can be replaced
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// urlDiscoverer turns statically listed URLs into nodes
+type urlDiscoverer struct{}
+
+func (urlDiscoverer) Validate(specs []Spec) error {
+
+	for _, s := range specs {
+		us := s.URLSpecs()
+		if len(us) == 0 {
+			errm := fmt.Sprintf("discover: url cluster %v needs at least one url", s.Cluster)
+			return errors.New(errm)
+		}
+		for _, u := range us {
+			if _, err := parseVaultURL(u.URL); err != nil {
+				errm := fmt.Sprintf("discover: url cluster %v: %v", s.Cluster, err)
+				return errors.New(errm)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (urlDiscoverer) Discover(specs []Spec) []Result {
+
+	var res []Result
+	for _, s := range specs {
+		r := Result{Cluster: s.Cluster}
+		for _, us := range s.URLSpecs() {
+			nodes, err := urlNodes(s.Cluster, us)
+			if err != nil {
+				r.Fault = append(r.Fault, err)
+				continue
+			}
+			r.Nodes = append(r.Nodes, nodes...)
+		}
+		if dbgDiscoverPkg {
+			log.Printf("url: discovered nodes of cluster %v: %v", s.Cluster, r.Nodes)
+		}
+		res = append(res, r)
+	}
+
+	return res
+}
+
+// parseVaultURL checks that a URL can be used as the address of a vault node
+func parseVaultURL(raw string) (*url.URL, error) {
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		errm := fmt.Sprintf("url %v must use http or https", raw)
+		return nil, errors.New(errm)
+	}
+	if u.Hostname() == "" {
+		errm := fmt.Sprintf("url %v has no host", raw)
+		return nil, errors.New(errm)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		errm := fmt.Sprintf("url %v must not have a path or a query, the vault API path is added to it", raw)
+		return nil, errors.New(errm)
+	}
+
+	return u, nil
+}
+
+// urlNodes returns the node of a URL, or one node per A record of its host in resolve mode
+func urlNodes(cluster string, us URLSpec) ([]Node, error) {
+
+	u, err := parseVaultURL(us.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	port := u.Port()
+
+	if !us.Resolve || net.ParseIP(host) != nil {
+		n := Node{
+			Cluster:       cluster,
+			Address:       u.Scheme + "://" + u.Host,
+			TLSServerName: us.TLSServerName,
+			CACert:        us.CACert,
+		}
+		return []Node{n}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		errm := fmt.Sprintf("url: unable to resolve %v: %v", host, err)
+		return nil, errors.New(errm)
+	}
+
+	// step: the nodes are reached by IP, their certificates are still verified against the URL host
+	sn := us.TLSServerName
+	if sn == "" {
+		sn = host
+	}
+	var nodes []Node
+	for _, a := range addrs {
+		ip4 := a.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		addr := ip4.String()
+		if port != "" {
+			addr = net.JoinHostPort(addr, port)
+		}
+		nodes = append(nodes, Node{
+			Cluster:       cluster,
+			Address:       u.Scheme + "://" + addr,
+			TLSServerName: sn,
+			CACert:        us.CACert,
+		})
+	}
+	if len(nodes) == 0 {
+		errm := fmt.Sprintf("url: %v has no A records", host)
+		return nil, errors.New(errm)
+	}
+
+	return nodes, nil
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stefancocora/vaultguard/pkg/secret"
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters as recommended by the scrypt package documentation
+const (
+	scryptN      = 32768
+	scryptR      = 8
+	scryptP      = 1
+	fileKeyLen   = 32
+	fileSaltLen  = 16
+	fileVersion  = 1
+	fileSuffix   = ".json.enc"
+	fileDirPerms = 0700
+)
+
+// FileStore keeps the init material in passphrase encrypted local files, one per cluster
+type FileStore struct {
+	dir        string
+	passphrase []byte
+}
+
+// fileEnvelope is the on disk format of an encrypted FileStore entry
+type fileEnvelope struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// NewFileStore creates a FileStore that writes to dir and encrypts with a key derived from passphrase
+func NewFileStore(dir string, passphrase string) *FileStore {
+	return &FileStore{
+		dir:        dir,
+		passphrase: []byte(passphrase),
+	}
+}
+
+// Put encrypts the init material with AES-GCM under a scrypt derived key and writes it to disk
+func (f *FileStore) Put(cluster string, m *Material) error {
+
+	if err := validCluster(cluster); err != nil {
+		return err
+	}
+
+	pt, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	defer secret.Zero(pt)
+
+	env := fileEnvelope{
+		Version: fileVersion,
+		Salt:    make([]byte, fileSaltLen),
+	}
+	if _, err := io.ReadFull(rand.Reader, env.Salt); err != nil {
+		return err
+	}
+	gcm, err := f.aead(env.Salt)
+	if err != nil {
+		return err
+	}
+	env.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, env.Nonce); err != nil {
+		return err
+	}
+	env.Ciphertext = gcm.Seal(nil, env.Nonce, pt, []byte(cluster))
+
+	b, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(f.dir, fileDirPerms); err != nil {
+		errm := fmt.Sprintf("keystore: unable to create directory %v: %v", f.dir, err)
+		return errors.New(errm)
+	}
+
+	// step: write to a temporary file and rename it so that a crash never leaves a truncated entry behind
+	tmp, err := ioutil.TempFile(f.dir, "."+cluster)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path(cluster))
+}
+
+// Exists reports if the init material file of a cluster is there
+func (f *FileStore) Exists(cluster string) (bool, error) {
+
+	if err := validCluster(cluster); err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(f.path(cluster)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Get reads and decrypts the init material of a cluster
+func (f *FileStore) Get(cluster string) (*Material, error) {
+
+	if err := validCluster(cluster); err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(f.path(cluster))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	var env fileEnvelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		errm := fmt.Sprintf("keystore: unable to decode %v: %v", f.path(cluster), err)
+		return nil, errors.New(errm)
+	}
+	if env.Version != fileVersion {
+		errm := fmt.Sprintf("keystore: unsupported file version %v in %v", env.Version, f.path(cluster))
+		return nil, errors.New(errm)
+	}
+
+	gcm, err := f.aead(env.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != gcm.NonceSize() {
+		errm := fmt.Sprintf("keystore: invalid nonce in %v", f.path(cluster))
+		return nil, errors.New(errm)
+	}
+	pt, err := gcm.Open(nil, env.Nonce, env.Ciphertext, []byte(cluster))
+	if err != nil {
+		errm := fmt.Sprintf("keystore: unable to decrypt %v, wrong passphrase?", f.path(cluster))
+		return nil, errors.New(errm)
+	}
+	defer secret.Zero(pt)
+
+	var m Material
+	if err := json.Unmarshal(pt, &m); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func (f *FileStore) path(cluster string) string {
+	return filepath.Join(f.dir, cluster+fileSuffix)
+}
+
+// aead derives the file key from the passphrase and salt
+func (f *FileStore) aead(salt []byte) (cipher.AEAD, error) {
+
+	key, err := scrypt.Key(f.passphrase, salt, scryptN, scryptR, scryptP, fileKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Zero(key)
+
+	return newGCM(key)
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// supported keystore types
+const (
+	TypeFile = "file"
+	TypeSSM  = "ssm"
+	TypeS3   = "s3"
+)
+
+const (
+	defaultPassphraseEnv   = "VAULTGUARD_KEYSTORE_PASSPHRASE"
+	defaultParameterPrefix = "/vaultguard"
+)
+
+// ErrNotFound is returned by Get when nothing has been stored for a cluster
+var ErrNotFound = errors.New("keystore: no init material stored for cluster")
+
+// KeyStore persists the init material of vault clusters
+type KeyStore interface {
+	// Put stores the init material of a cluster, replacing what was there before
+	Put(cluster string, m *Material) error
+	// Get returns the init material of a cluster or ErrNotFound
+	Get(cluster string) (*Material, error)
+	// Exists reports if init material is stored for a cluster, it only reads metadata and never decrypts anything
+	Exists(cluster string) (bool, error)
+}
+
+// Material is the output of a vault init: the unseal key shares and the root token
+type Material struct {
+	Cluster   string   `json:"cluster"`
+	Node      string   `json:"node"`
+	Keys      []string `json:"keys"`
+	KeysB64   []string `json:"keys_base64"`
+	RootToken string   `json:"root_token,omitempty"`
+	// Envelope is set when the secrets above are envelope encrypted, eg "kms"
+	Envelope string `json:"envelope,omitempty"`
+}
+
+// String keeps the secrets out of logs and debug dumps
+func (m Material) String() string {
+	return fmt.Sprintf("keystore.Material{Cluster: %v, Node: %v, Keys: %v redacted, RootToken: %v, Envelope: %v}", m.Cluster, m.Node, len(m.Keys), m.RootToken != "", m.Envelope)
+}
+
+// GoString keeps the secrets out of %#v formatting
+func (m Material) GoString() string {
+	return m.String()
+}
+
+// Config selects and configures the keystore of a vault endpoint
+type Config struct {
+	Type string `yaml:"type" json:"type"`
+	// file
+	Path          string `yaml:"path,omitempty" json:"path,omitempty"`
+	PassphraseEnv string `yaml:"passphrase_env,omitempty" json:"passphrase_env,omitempty"`
+	// ssm and s3
+	Region   string `yaml:"region,omitempty" json:"region,omitempty"`
+	KMSKeyID string `yaml:"kms_key_id,omitempty" json:"kms_key_id,omitempty"`
+	// ssm
+	ParameterPrefix string `yaml:"parameter_prefix,omitempty" json:"parameter_prefix,omitempty"`
+	// s3
+	Bucket string `yaml:"bucket,omitempty" json:"bucket,omitempty"`
+	Prefix string `yaml:"prefix,omitempty" json:"prefix,omitempty"`
+	// KMS envelope encryption of the secrets, on top of whatever the store itself does, required for every keystore type
+	EnvelopeKeyID string `yaml:"envelope_kms_key_id,omitempty" json:"envelope_kms_key_id,omitempty"`
+}
+
+// Enabled reports if a keystore has been configured
+func (c Config) Enabled() bool {
+	return c.Type != ""
+}
+
+// Validate checks that the config contains everything the selected keystore type needs
+func (c Config) Validate() error {
+
+	switch c.Type {
+	case "":
+		return nil
+	case TypeFile:
+		if c.Path == "" {
+			return errors.New("keystore: file keystore needs a path")
+		}
+	case TypeSSM:
+		if c.Region == "" {
+			return errors.New("keystore: ssm keystore needs a region")
+		}
+		if c.ParameterPrefix != "" && !strings.HasPrefix(c.ParameterPrefix, "/") {
+			errm := fmt.Sprintf("keystore: ssm parameter_prefix must start with /: %v", c.ParameterPrefix)
+			return errors.New(errm)
+		}
+	case TypeS3:
+		if c.Region == "" || c.Bucket == "" {
+			return errors.New("keystore: s3 keystore needs a region and a bucket")
+		}
+	default:
+		errm := fmt.Sprintf("keystore: unsupported keystore type %v", c.Type)
+		return errors.New(errm)
+	}
+
+	// step: the unseal keys and root token must never be stored without envelope encryption
+	if c.EnvelopeKeyID == "" {
+		return errors.New("keystore: envelope_kms_key_id is required, the secrets are always KMS envelope encrypted")
+	}
+	if c.Region == "" {
+		return errors.New("keystore: KMS envelope encryption needs a region")
+	}
+
+	return nil
+}
+
+// New creates the keystore selected by the config, wrapped in KMS envelope encryption
+func New(c Config) (KeyStore, error) {
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	ks, err := newStore(c)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := session.NewSession(aws.NewConfig().WithRegion(c.Region))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKMSEnvelope(ks, kms.New(sess), c.EnvelopeKeyID), nil
+}
+
+// newStore creates the backing store selected by the config
+func newStore(c Config) (KeyStore, error) {
+
+	switch c.Type {
+	case TypeFile:
+		env := c.PassphraseEnv
+		if env == "" {
+			env = defaultPassphraseEnv
+		}
+		pass := os.Getenv(env)
+		if pass == "" {
+			errm := fmt.Sprintf("keystore: the file keystore passphrase env var %v is empty", env)
+			return nil, errors.New(errm)
+		}
+		return NewFileStore(c.Path, pass), nil
+	case TypeSSM:
+		sess, err := session.NewSession(aws.NewConfig().WithRegion(c.Region))
+		if err != nil {
+			return nil, err
+		}
+		prefix := c.ParameterPrefix
+		if prefix == "" {
+			prefix = defaultParameterPrefix
+		}
+		return NewSSMStore(ssm.New(sess), prefix, c.KMSKeyID), nil
+	case TypeS3:
+		sess, err := session.NewSession(aws.NewConfig().WithRegion(c.Region))
+		if err != nil {
+			return nil, err
+		}
+		return NewS3Store(s3.New(sess), c.Bucket, c.Prefix, c.KMSKeyID), nil
+	}
+
+	return nil, errors.New("keystore: no keystore configured")
+}
+
+// validCluster makes sure a cluster name can be used as part of a file name, parameter name or object key
+func validCluster(cluster string) error {
+	if cluster == "" || cluster == "." || cluster == ".." || strings.ContainsAny(cluster, "/\\") {
+		errm := fmt.Sprintf("keystore: invalid cluster name %q", cluster)
+		return errors.New(errm)
+	}
+	return nil
+}
@@ -0,0 +1,436 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// fakeSSM keeps parameters in memory, only the calls SSMStore makes are implemented
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	params map[string]*ssm.PutParameterInput
+	// decrypted counts the reads that asked SSM to decrypt the parameter
+	decrypted int
+}
+
+func newFakeSSM() *fakeSSM {
+	return &fakeSSM{params: make(map[string]*ssm.PutParameterInput)}
+}
+
+func (f *fakeSSM) PutParameter(in *ssm.PutParameterInput) (*ssm.PutParameterOutput, error) {
+	f.params[*in.Name] = in
+	return &ssm.PutParameterOutput{}, nil
+}
+
+func (f *fakeSSM) GetParameter(in *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	if aws.BoolValue(in.WithDecryption) {
+		f.decrypted++
+	}
+	p, ok := f.params[*in.Name]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "parameter not found", nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: p.Name, Type: p.Type, Value: p.Value}}, nil
+}
+
+// fakeS3 keeps objects in memory, only the calls S3Store makes are implemented
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+	sse     map[string]*string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte), sse: make(map[string]*string)}
+}
+
+func (f *fakeS3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	b, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	k := *in.Bucket + "/" + *in.Key
+	f.objects[k] = b
+	f.sse[k] = in.ServerSideEncryption
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	k := *in.Bucket + "/" + *in.Key
+	b, ok := f.objects[k]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(b)), ServerSideEncryption: f.sse[k]}, nil
+}
+
+func (f *fakeS3) HeadObject(in *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	k := *in.Bucket + "/" + *in.Key
+	b, ok := f.objects[k]
+	if !ok {
+		return nil, awserr.New("NotFound", "not found", nil)
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(b))), ServerSideEncryption: f.sse[k]}, nil
+}
+
+// fakeKMS wraps data keys under an in memory master key per key id, bound to the encryption context like KMS does
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	keys     map[string][]byte
+	decrypts int
+}
+
+func newFakeKMS(keyIDs ...string) *fakeKMS {
+	f := &fakeKMS{keys: make(map[string][]byte)}
+	for _, id := range keyIDs {
+		f.keys[id] = randomBytes(32)
+	}
+	return f
+}
+
+// fakeBlob is the data key encrypted under a master key
+type fakeBlob struct {
+	KeyID      string
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func contextAAD(ec map[string]*string) []byte {
+	var ks []string
+	for k := range ec {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	var b bytes.Buffer
+	for _, k := range ks {
+		b.WriteString(k + "=" + aws.StringValue(ec[k]) + ";")
+	}
+	return b.Bytes()
+}
+
+func (f *fakeKMS) GenerateDataKey(in *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	mk, ok := f.keys[*in.KeyId]
+	if !ok {
+		return nil, awserr.New(kms.ErrCodeNotFoundException, "key not found", nil)
+	}
+	gcm, err := newGCM(mk)
+	if err != nil {
+		return nil, err
+	}
+	pt := randomBytes(32)
+	fb := fakeBlob{KeyID: *in.KeyId, Nonce: randomBytes(gcm.NonceSize())}
+	fb.Ciphertext = gcm.Seal(nil, fb.Nonce, pt, contextAAD(in.EncryptionContext))
+	blob, err := json.Marshal(fb)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GenerateDataKeyOutput{KeyId: in.KeyId, Plaintext: pt, CiphertextBlob: blob}, nil
+}
+
+func (f *fakeKMS) Decrypt(in *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	f.decrypts++
+	var fb fakeBlob
+	if err := json.Unmarshal(in.CiphertextBlob, &fb); err != nil {
+		return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, "invalid ciphertext", nil)
+	}
+	mk, ok := f.keys[fb.KeyID]
+	if !ok {
+		return nil, awserr.New(kms.ErrCodeNotFoundException, "key not found", nil)
+	}
+	gcm, err := newGCM(mk)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := gcm.Open(nil, fb.Nonce, fb.Ciphertext, contextAAD(in.EncryptionContext))
+	if err != nil {
+		return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, "invalid ciphertext", nil)
+	}
+	return &kms.DecryptOutput{KeyId: aws.String(fb.KeyID), Plaintext: pt}, nil
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func testMaterial() *Material {
+	return &Material{
+		Cluster:   "vault-a",
+		Node:      "https://10.0.0.1:8200",
+		Keys:      []string{"key-one", "key-two", "key-three"},
+		KeysB64:   []string{"a2V5LW9uZQ==", "a2V5LXR3bw==", "a2V5LXRocmVl"},
+		RootToken: "s.root",
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestKeyStores(t *testing.T) {
+
+	tests := []struct {
+		name string
+		// store returns the keystore to write with and the one to read back with
+		store func(t *testing.T) (KeyStore, KeyStore)
+		// getErr expects reading back to fail, otherwise the material must round trip
+		getErr bool
+		// check verifies what the backing store holds
+		check func(t *testing.T, w KeyStore)
+	}{
+		{
+			name: "file round trip",
+			store: func(t *testing.T) (KeyStore, KeyStore) {
+				dir := tempDir(t)
+				return NewFileStore(dir, "passphrase"), NewFileStore(dir, "passphrase")
+			},
+			check: func(t *testing.T, w KeyStore) {
+				b, err := ioutil.ReadFile(w.(*FileStore).path("vault-a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(b, []byte("key-one")) || bytes.Contains(b, []byte("s.root")) {
+					t.Errorf("the file holds the secrets in plain text")
+				}
+			},
+		},
+		{
+			name: "file wrong passphrase",
+			store: func(t *testing.T) (KeyStore, KeyStore) {
+				dir := tempDir(t)
+				return NewFileStore(dir, "passphrase"), NewFileStore(dir, "another passphrase")
+			},
+			getErr: true,
+		},
+		{
+			name: "ssm round trip",
+			store: func(t *testing.T) (KeyStore, KeyStore) {
+				s := NewSSMStore(newFakeSSM(), "/vaultguard/", "alias/vaultguard")
+				return s, s
+			},
+			check: func(t *testing.T, w KeyStore) {
+				p, ok := w.(*SSMStore).svc.(*fakeSSM).params["/vaultguard/vault-a"]
+				if !ok {
+					t.Fatalf("no parameter written to /vaultguard/vault-a")
+				}
+				if *p.Type != ssm.ParameterTypeSecureString || aws.StringValue(p.KeyId) != "alias/vaultguard" {
+					t.Errorf("parameter is a %v encrypted with %q, expected a SecureString encrypted with alias/vaultguard", *p.Type, aws.StringValue(p.KeyId))
+				}
+			},
+		},
+		{
+			name: "s3 round trip",
+			store: func(t *testing.T) (KeyStore, KeyStore) {
+				s := NewS3Store(newFakeS3(), "bucket", "vaultguard/", "")
+				return s, s
+			},
+			check: func(t *testing.T, w KeyStore) {
+				if sse := w.(*S3Store).svc.(*fakeS3).sse["bucket/vaultguard/vault-a.json"]; aws.StringValue(sse) != s3.ServerSideEncryptionAwsKms {
+					t.Errorf("object written with server side encryption %q", aws.StringValue(sse))
+				}
+			},
+		},
+		{
+			name: "s3 object without SSE-KMS",
+			store: func(t *testing.T) (KeyStore, KeyStore) {
+				f := newFakeS3()
+				s := NewS3Store(f, "bucket", "", "")
+				return &sseStripper{s, f}, s
+			},
+			getErr: true,
+		},
+		{
+			name: "kms envelope round trip",
+			store: func(t *testing.T) (KeyStore, KeyStore) {
+				s := NewKMSEnvelope(NewSSMStore(newFakeSSM(), "/vaultguard", ""), newFakeKMS("cmk"), "cmk")
+				return s, s
+			},
+			check: func(t *testing.T, w KeyStore) {
+				em, err := w.(*KMSEnvelope).next.Get("vault-a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if em.Envelope != EnvelopeKMS || em.RootToken == "s.root" || em.Keys[0] == "key-one" || em.KeysB64[0] == "a2V5LW9uZQ==" {
+					t.Errorf("the wrapped store holds the secrets without envelope: %#v", em)
+				}
+			},
+		},
+		{
+			name: "kms envelope under another CMK",
+			store: func(t *testing.T) (KeyStore, KeyStore) {
+				next := NewSSMStore(newFakeSSM(), "/vaultguard", "")
+				return NewKMSEnvelope(next, newFakeKMS("cmk"), "cmk"), NewKMSEnvelope(next, newFakeKMS("cmk"), "cmk")
+			},
+			getErr: true,
+		},
+		{
+			name: "kms envelope read without envelope",
+			store: func(t *testing.T) (KeyStore, KeyStore) {
+				next := NewSSMStore(newFakeSSM(), "/vaultguard", "")
+				return next, NewKMSEnvelope(next, newFakeKMS("cmk"), "cmk")
+			},
+			getErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, r := tt.store(t)
+			if fs, ok := w.(*FileStore); ok {
+				defer os.RemoveAll(fs.dir)
+			}
+
+			if _, err := r.Get("vault-a"); err != ErrNotFound {
+				t.Fatalf("Get before Put returned %v, expected ErrNotFound", err)
+			}
+			if ok, err := r.Exists("vault-a"); ok || err != nil {
+				t.Fatalf("Exists before Put returned %v, %v", ok, err)
+			}
+
+			m := testMaterial()
+			if err := w.Put("vault-a", m); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if tt.check != nil {
+				tt.check(t, w)
+			}
+			if ok, err := r.Exists("vault-a"); !ok || err != nil {
+				t.Fatalf("Exists after Put returned %v, %v", ok, err)
+			}
+
+			got, err := r.Get("vault-a")
+			if tt.getErr {
+				if err == nil {
+					t.Fatalf("Get succeeded, expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if !reflect.DeepEqual(got, testMaterial()) {
+				t.Errorf("Get returned %#v, expected %#v", got, testMaterial())
+			}
+
+			if _, err := r.Get("vault-b"); err != ErrNotFound {
+				t.Errorf("Get of a missing cluster returned %v, expected ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestExistsDoesNotDecrypt(t *testing.T) {
+
+	fs, fk := newFakeSSM(), newFakeKMS("cmk")
+	ks := NewKMSEnvelope(NewSSMStore(fs, "/vaultguard", "alias/vaultguard"), fk, "cmk")
+	if err := ks.Put("vault-a", testMaterial()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cluster := range []string{"vault-a", "vault-b"} {
+		if _, err := ks.Exists(cluster); err != nil {
+			t.Fatalf("Exists %v: %v", cluster, err)
+		}
+	}
+	if fs.decrypted != 0 || fk.decrypts != 0 {
+		t.Errorf("Exists decrypted the material: %v ssm decryptions, %v kms decryptions", fs.decrypted, fk.decrypts)
+	}
+}
+
+// sseStripper writes through an S3Store and then drops the server side encryption of the object, like an object uploaded by hand
+type sseStripper struct {
+	*S3Store
+	f *fakeS3
+}
+
+func (s *sseStripper) Put(cluster string, m *Material) error {
+	if err := s.S3Store.Put(cluster, m); err != nil {
+		return err
+	}
+	s.f.sse[s.bucket+"/"+s.key(cluster)] = nil
+	return nil
+}
+
+func TestInvalidCluster(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	stores := map[string]KeyStore{
+		"file": NewFileStore(dir, "passphrase"),
+		"ssm":  NewSSMStore(newFakeSSM(), "/vaultguard", ""),
+		"s3":   NewS3Store(newFakeS3(), "bucket", "", ""),
+	}
+	for name, ks := range stores {
+		for _, cluster := range []string{"", ".", "..", "a/b", `a\b`} {
+			if err := ks.Put(cluster, testMaterial()); err == nil {
+				t.Errorf("%v: Put accepted the cluster name %q", name, cluster)
+			}
+			if _, err := ks.Get(cluster); err == nil || err == ErrNotFound {
+				t.Errorf("%v: Get of the cluster name %q returned %v", name, cluster, err)
+			}
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+
+	cases := []struct {
+		name  string
+		c     Config
+		valid bool
+	}{
+		{name: "no keystore", c: Config{}, valid: true},
+		{name: "file with envelope", c: Config{Type: TypeFile, Path: "/tmp", Region: "eu-west-1", EnvelopeKeyID: "alias/vaultguard"}, valid: true},
+		{name: "ssm with envelope", c: Config{Type: TypeSSM, Region: "eu-west-1", EnvelopeKeyID: "alias/vaultguard"}, valid: true},
+		{name: "file without envelope", c: Config{Type: TypeFile, Path: "/tmp"}},
+		{name: "ssm without envelope", c: Config{Type: TypeSSM, Region: "eu-west-1"}},
+		{name: "s3 without envelope", c: Config{Type: TypeS3, Region: "eu-west-1", Bucket: "bucket"}},
+		{name: "envelope without region", c: Config{Type: TypeFile, Path: "/tmp", EnvelopeKeyID: "alias/vaultguard"}},
+	}
+	for _, tc := range cases {
+		err := tc.c.Validate()
+		if tc.valid && err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%v: expected the config to be rejected", tc.name)
+		}
+	}
+}
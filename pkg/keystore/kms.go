@@ -0,0 +1,239 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/stefancocora/vaultguard/pkg/secret"
+)
+
+// EnvelopeKMS marks material whose secrets are KMS envelope encrypted
+const EnvelopeKMS = "kms"
+
+const kmsSealedPrefix = "vaultguard:kms:v1:"
+
+// KMSEnvelope wraps a KeyStore and envelope encrypts every unseal key share and the root token
+// under a KMS CMK before the material reaches the wrapped store.
+// Each secret gets its own data key, bound to the cluster and init node through the KMS encryption context.
+type KMSEnvelope struct {
+	next  KeyStore
+	svc   kmsiface.KMSAPI
+	keyID string
+}
+
+// kmsSealed is a single envelope encrypted secret
+type kmsSealed struct {
+	// CiphertextBlob is the data key encrypted under the CMK
+	CiphertextBlob []byte `json:"blob"`
+	Nonce          []byte `json:"nonce"`
+	Ciphertext     []byte `json:"ciphertext"`
+}
+
+// NewKMSEnvelope creates a KMSEnvelope that encrypts under the CMK keyID and persists to next
+func NewKMSEnvelope(next KeyStore, svc kmsiface.KMSAPI, keyID string) *KMSEnvelope {
+	return &KMSEnvelope{
+		next:  next,
+		svc:   svc,
+		keyID: keyID,
+	}
+}
+
+// Put encrypts the secrets of the init material and hands the result to the wrapped store
+func (k *KMSEnvelope) Put(cluster string, m *Material) error {
+
+	ec := encryptionContext(cluster, m.Node)
+
+	em := &Material{
+		Cluster:  m.Cluster,
+		Node:     m.Node,
+		Envelope: EnvelopeKMS,
+	}
+	for i := range m.Keys {
+		s, err := k.seal(m.Keys[i], ec)
+		if err != nil {
+			return err
+		}
+		em.Keys = append(em.Keys, s)
+	}
+	for i := range m.KeysB64 {
+		s, err := k.seal(m.KeysB64[i], ec)
+		if err != nil {
+			return err
+		}
+		em.KeysB64 = append(em.KeysB64, s)
+	}
+	if m.RootToken != "" {
+		s, err := k.seal(m.RootToken, ec)
+		if err != nil {
+			return err
+		}
+		em.RootToken = s
+	}
+
+	return k.next.Put(cluster, em)
+}
+
+// Exists asks the wrapped store, nothing is decrypted
+func (k *KMSEnvelope) Exists(cluster string) (bool, error) {
+	return k.next.Exists(cluster)
+}
+
+// Get reads the material from the wrapped store and decrypts its secrets in memory
+func (k *KMSEnvelope) Get(cluster string) (*Material, error) {
+
+	em, err := k.next.Get(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if em.Envelope != EnvelopeKMS {
+		errm := fmt.Sprintf("keystore: init material of cluster %v is not KMS envelope encrypted", cluster)
+		return nil, errors.New(errm)
+	}
+
+	ec := encryptionContext(cluster, em.Node)
+
+	m := &Material{
+		Cluster: em.Cluster,
+		Node:    em.Node,
+	}
+	for i := range em.Keys {
+		s, err := k.open(em.Keys[i], ec)
+		if err != nil {
+			return nil, err
+		}
+		m.Keys = append(m.Keys, s)
+	}
+	for i := range em.KeysB64 {
+		s, err := k.open(em.KeysB64[i], ec)
+		if err != nil {
+			return nil, err
+		}
+		m.KeysB64 = append(m.KeysB64, s)
+	}
+	if em.RootToken != "" {
+		s, err := k.open(em.RootToken, ec)
+		if err != nil {
+			return nil, err
+		}
+		m.RootToken = s
+	}
+
+	return m, nil
+}
+
+// seal encrypts a single secret under a fresh data key
+func (k *KMSEnvelope) seal(plain string, ec map[string]*string) (string, error) {
+
+	input := &kms.GenerateDataKeyInput{
+		KeyId:             aws.String(k.keyID),
+		KeySpec:           aws.String(kms.DataKeySpecAes256),
+		EncryptionContext: ec,
+	}
+	dk, err := k.svc.GenerateDataKey(input)
+	if err != nil {
+		errm := fmt.Sprintf("keystore: unable to generate a data key with %v: %v", k.keyID, err)
+		return "", errors.New(errm)
+	}
+	defer secret.Zero(dk.Plaintext)
+
+	gcm, err := newGCM(dk.Plaintext)
+	if err != nil {
+		return "", err
+	}
+	s := kmsSealed{
+		CiphertextBlob: dk.CiphertextBlob,
+		Nonce:          make([]byte, gcm.NonceSize()),
+	}
+	if _, err := io.ReadFull(rand.Reader, s.Nonce); err != nil {
+		return "", err
+	}
+	s.Ciphertext = gcm.Seal(nil, s.Nonce, []byte(plain), nil)
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+
+	return kmsSealedPrefix + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// open decrypts a single secret, KMS refuses to decrypt the data key if the encryption context doesn't match
+func (k *KMSEnvelope) open(sealed string, ec map[string]*string) (string, error) {
+
+	if !strings.HasPrefix(sealed, kmsSealedPrefix) {
+		return "", errors.New("keystore: secret is not KMS envelope encrypted")
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, kmsSealedPrefix))
+	if err != nil {
+		return "", err
+	}
+	var s kmsSealed
+	if err := json.Unmarshal(b, &s); err != nil {
+		return "", err
+	}
+
+	input := &kms.DecryptInput{
+		CiphertextBlob:    s.CiphertextBlob,
+		EncryptionContext: ec,
+	}
+	dk, err := k.svc.Decrypt(input)
+	if err != nil {
+		errm := fmt.Sprintf("keystore: unable to decrypt a data key: %v", err)
+		return "", errors.New(errm)
+	}
+	defer secret.Zero(dk.Plaintext)
+
+	gcm, err := newGCM(dk.Plaintext)
+	if err != nil {
+		return "", err
+	}
+	if len(s.Nonce) != gcm.NonceSize() {
+		return "", errors.New("keystore: invalid envelope nonce")
+	}
+	pt, err := gcm.Open(nil, s.Nonce, s.Ciphertext, nil)
+	if err != nil {
+		return "", errors.New("keystore: unable to decrypt an envelope encrypted secret")
+	}
+	defer secret.Zero(pt)
+
+	return string(pt), nil
+}
+
+// encryptionContext binds the data keys to the cluster and to the node it was initialized through
+func encryptionContext(cluster string, node string) map[string]*string {
+	return map[string]*string{
+		"cluster": aws.String(cluster),
+		"node":    aws.String(node),
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stefancocora/vaultguard/pkg/secret"
+)
+
+// S3Store keeps the init material in SSE-KMS encrypted S3 objects, one per cluster
+type S3Store struct {
+	svc    s3iface.S3API
+	bucket string
+	prefix string
+	keyID  string
+}
+
+// NewS3Store creates an S3Store that writes objects under prefix in bucket.
+// When keyID is empty the account default aws/s3 KMS key encrypts the objects.
+func NewS3Store(svc s3iface.S3API, bucket string, prefix string, keyID string) *S3Store {
+	return &S3Store{
+		svc:    svc,
+		bucket: bucket,
+		prefix: prefix,
+		keyID:  keyID,
+	}
+}
+
+// Put writes the init material of a cluster to an SSE-KMS encrypted object
+func (s *S3Store) Put(cluster string, m *Material) error {
+
+	if err := validCluster(cluster); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.key(cluster)),
+		Body:                 bytes.NewReader(b),
+		ContentType:          aws.String("application/json"),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAwsKms),
+	}
+	if s.keyID != "" {
+		input.SSEKMSKeyId = aws.String(s.keyID)
+	}
+
+	if _, err := s.svc.PutObject(input); err != nil {
+		errm := fmt.Sprintf("keystore: unable to put s3 object s3://%v/%v: %v", s.bucket, s.key(cluster), err)
+		return errors.New(errm)
+	}
+
+	return nil
+}
+
+// Exists reports if the init material object of a cluster is there, HeadObject reads its metadata only
+func (s *S3Store) Exists(cluster string) (bool, error) {
+
+	if err := validCluster(cluster); err != nil {
+		return false, err
+	}
+
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(cluster)),
+	}
+	if _, err := s.svc.HeadObject(input); err != nil {
+		// step: HEAD responses have no body, a missing object comes back as a bare NotFound
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey) {
+			return false, nil
+		}
+		errm := fmt.Sprintf("keystore: unable to head s3 object s3://%v/%v: %v", s.bucket, s.key(cluster), err)
+		return false, errors.New(errm)
+	}
+
+	return true, nil
+}
+
+// Get reads the init material object of a cluster, S3 decrypts it transparently
+func (s *S3Store) Get(cluster string) (*Material, error) {
+
+	if err := validCluster(cluster); err != nil {
+		return nil, err
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(cluster)),
+	}
+	result, err := s.svc.GetObject(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, ErrNotFound
+		}
+		errm := fmt.Sprintf("keystore: unable to get s3 object s3://%v/%v: %v", s.bucket, s.key(cluster), err)
+		return nil, errors.New(errm)
+	}
+	defer result.Body.Close()
+
+	if result.ServerSideEncryption == nil || *result.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		errm := fmt.Sprintf("keystore: s3 object s3://%v/%v is not SSE-KMS encrypted", s.bucket, s.key(cluster))
+		return nil, errors.New(errm)
+	}
+
+	b, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Zero(b)
+
+	var m Material
+	if err := json.Unmarshal(b, &m); err != nil {
+		errm := fmt.Sprintf("keystore: unable to decode s3 object s3://%v/%v: %v", s.bucket, s.key(cluster), err)
+		return nil, errors.New(errm)
+	}
+
+	return &m, nil
+}
+
+func (s *S3Store) key(cluster string) string {
+	return s.prefix + cluster + ".json"
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// SSMStore keeps the init material in SSM Parameter Store SecureString parameters, one per cluster
+type SSMStore struct {
+	svc    ssmiface.SSMAPI
+	prefix string
+	keyID  string
+}
+
+// NewSSMStore creates an SSMStore that writes parameters under prefix.
+// When keyID is empty the account default aws/ssm KMS key encrypts the parameters.
+func NewSSMStore(svc ssmiface.SSMAPI, prefix string, keyID string) *SSMStore {
+	return &SSMStore{
+		svc:    svc,
+		prefix: strings.TrimSuffix(prefix, "/"),
+		keyID:  keyID,
+	}
+}
+
+// Put writes the init material of a cluster as a SecureString parameter
+func (s *SSMStore) Put(cluster string, m *Material) error {
+
+	if err := validCluster(cluster); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	input := &ssm.PutParameterInput{
+		Name:        aws.String(s.name(cluster)),
+		Description: aws.String(fmt.Sprintf("vaultguard init material for vault cluster %v", cluster)),
+		Type:        aws.String(ssm.ParameterTypeSecureString),
+		Value:       aws.String(string(b)),
+		Overwrite:   aws.Bool(true),
+	}
+	if s.keyID != "" {
+		input.KeyId = aws.String(s.keyID)
+	}
+
+	if _, err := s.svc.PutParameter(input); err != nil {
+		errm := fmt.Sprintf("keystore: unable to put ssm parameter %v: %v", s.name(cluster), err)
+		return errors.New(errm)
+	}
+
+	return nil
+}
+
+// Exists reports if the parameter of a cluster is there, without asking SSM to decrypt it
+func (s *SSMStore) Exists(cluster string) (bool, error) {
+
+	if err := validCluster(cluster); err != nil {
+		return false, err
+	}
+
+	input := &ssm.GetParameterInput{
+		Name:           aws.String(s.name(cluster)),
+		WithDecryption: aws.Bool(false),
+	}
+	if _, err := s.svc.GetParameter(input); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+			return false, nil
+		}
+		errm := fmt.Sprintf("keystore: unable to get ssm parameter %v: %v", s.name(cluster), err)
+		return false, errors.New(errm)
+	}
+
+	return true, nil
+}
+
+// Get reads and decrypts the SecureString parameter of a cluster
+func (s *SSMStore) Get(cluster string) (*Material, error) {
+
+	if err := validCluster(cluster); err != nil {
+		return nil, err
+	}
+
+	input := &ssm.GetParameterInput{
+		Name:           aws.String(s.name(cluster)),
+		WithDecryption: aws.Bool(true),
+	}
+	result, err := s.svc.GetParameter(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+			return nil, ErrNotFound
+		}
+		errm := fmt.Sprintf("keystore: unable to get ssm parameter %v: %v", s.name(cluster), err)
+		return nil, errors.New(errm)
+	}
+	if result.Parameter == nil || result.Parameter.Value == nil {
+		return nil, ErrNotFound
+	}
+
+	var m Material
+	if err := json.Unmarshal([]byte(*result.Parameter.Value), &m); err != nil {
+		errm := fmt.Sprintf("keystore: unable to decode ssm parameter %v: %v", s.name(cluster), err)
+		return nil, errors.New(errm)
+	}
+
+	return &m, nil
+}
+
+func (s *SSMStore) name(cluster string) string {
+	return s.prefix + "/" + cluster
+}
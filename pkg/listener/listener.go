@@ -15,6 +15,7 @@ package listener
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -25,7 +26,7 @@ import (
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
-	ecs "github.com/stefancocora/vaultguard/pkg/discover/aws"
+	"github.com/stefancocora/vaultguard/pkg/discover"
 	"github.com/stefancocora/vaultguard/pkg/server"
 	vaultg "github.com/stefancocora/vaultguard/pkg/vault"
 )
@@ -59,7 +60,8 @@ func Entrypoint(srvConfig DbgConfig) error {
 	log.Println("reading config file")
 	var vgconf vaultg.Config
 	if err := vgconf.New(); err != nil {
-		log.Printf("unable to create vaultguard configuration %v", err)
+		errm := fmt.Sprintf("unable to create vaultguard configuration: %v", err)
+		return errors.New(errm)
 	}
 
 	// step: launch long running daemon and additional workers
@@ -94,17 +96,47 @@ func run(srvConfig DbgConfig, vgconf vaultg.Config) {
 		Type: "HTTPSrv",
 		ID:   1,
 	}
-	go runHTTPSrv(ctx, srvConfig, vgconf, wg, id)
+	// the key ceremony learns about the vault nodes once they are discovered
+	var kc *vaultg.KeyCeremony
+	if vgconf.GuardConfig.Ceremony.Enabled {
+		rediscover := func() map[string][]string {
+			dv, _ := runDsc(srvConfig, vgconf)
+			return dv
+		}
+		kc = vaultg.NewKeyCeremony(vgconf, rediscover, vaultg.WorkerID{Name: "ceremonyWrk", Type: "ceremony", ID: 1})
+	}
+	// the configure and reconcile workers publish the transit key rotations and the drift on /status
+	status := vaultg.NewStatus()
+	go runHTTPSrv(ctx, srvConfig, vgconf, kc, status, wg, id)
 
 	// step: discover vault servers
 	// channel for discovered vault endpoints to send to init
 	var dvinitCh = make(chan map[string][]string, 1)
+	// channel for discovered vault endpoints to send to unseal
+	var dvunsealCh = make(chan map[string][]string, 1)
+	// channel for discovered vault endpoints to send to configure
+	var dvconfigureCh = make(chan map[string][]string, 1)
+	// channel for discovered vault endpoints to send to reconcile
+	var dvreconcileCh = make(chan map[string][]string, 1)
 	// channel for errors that we get during init phase
 	retErrChInit := make(chan error)
+	// channel for the output of the clusters initialized during the init phase
+	initCh := make(chan vaultg.InitResult)
 
-	log.Println("run: starting the ecsDsc worker")
-	dv := runEcsDsc(srvConfig, vgconf)
+	log.Println("run: starting the discovery")
+	dv, _ := runDsc(srvConfig, vgconf)
+	if kc != nil {
+		kc.SetNodes(dv)
+	}
 	dvinitCh <- dv
+	dvunsealCh <- dv
+	dvconfigureCh <- dv
+	dvreconcileCh <- dv
+	// channel for the unseal key shares of freshly initialized clusters
+	unsealKeyCh := make(chan vaultg.UnsealKeys, len(dv))
+	// channel for the init output the configure worker takes the root token from
+	configureInitCh := make(chan vaultg.InitResult, len(dv))
+	configure := vgconf.GuardConfig.Init || vgconf.ConfigureEnabled()
 
 	// step: start vaultInit worker
 	if debugListenerPtr {
@@ -119,7 +151,7 @@ func run(srvConfig DbgConfig, vgconf vaultg.Config) {
 			Type: "init",
 			ID:   1,
 		}
-		go vaultg.RunInit(ctx, vgconf, wg, retErrChInit, dvinitCh, id) // start vault Init worker
+		go vaultg.RunInit(ctx, vgconf, wg, retErrChInit, dvinitCh, initCh, id) // start vault Init worker
 	} else {
 		log.Printf("run: init phase is disabled in the config file: %v", vgconf.GuardConfig.Init)
 	}
@@ -129,7 +161,7 @@ func run(srvConfig DbgConfig, vgconf vaultg.Config) {
 		vaultg.PropagateDebug(srvConfig.Debug, srvConfig.DebugConfig)
 	}
 	retErrChUnseal := make(chan error)
-	if vgconf.GuardConfig.Init {
+	if vgconf.GuardConfig.Unseal {
 		log.Println("run: starting the vaultUnseal worker")
 		wg.Add(1)
 		id := vaultg.WorkerID{
@@ -137,9 +169,44 @@ func run(srvConfig DbgConfig, vgconf vaultg.Config) {
 			Type: "unseal",
 			ID:   1,
 		}
-		go vaultg.RunUnseal(ctx, vgconf, wg, retErrChUnseal, id) // start vault Init worker
+		go vaultg.RunUnseal(ctx, vgconf, wg, retErrChUnseal, dvunsealCh, unsealKeyCh, id) // start vault Unseal worker
+	} else {
+		log.Printf("run: unseal phase is disabled in the config file: %v", vgconf.GuardConfig.Unseal)
+	}
+
+	// step: start vaultConfigure worker
+	retErrChConfigure := make(chan error)
+	if configure {
+		log.Println("run: starting the vaultConfigure worker")
+		wg.Add(1)
+		id := vaultg.WorkerID{
+			Name: "vaultConfigureWrk",
+			Type: "configure",
+			ID:   1,
+		}
+		go vaultg.RunConfigure(ctx, vgconf, wg, retErrChConfigure, dvconfigureCh, configureInitCh, status, id) // start vault Configure worker
+	}
+
+	// step: start vaultReconcile worker
+	retErrChReconcile := make(chan error)
+	if vgconf.ReconcileEnabled() {
+		log.Println("run: starting the vaultReconcile worker")
+		wg.Add(1)
+		id := vaultg.WorkerID{
+			Name: "vaultReconcileWrk",
+			Type: "reconcile",
+			ID:   1,
+		}
+		rediscover := func() map[string][]string {
+			dv, _ := runDsc(srvConfig, vgconf)
+			if kc != nil {
+				kc.SetNodes(dv)
+			}
+			return dv
+		}
+		go vaultg.RunReconcile(ctx, vgconf, wg, retErrChReconcile, dvreconcileCh, rediscover, status, id) // start vault Reconcile worker
 	} else {
-		log.Printf("run: unseal phase is disabled in the config file: %v", vgconf.GuardConfig.Init)
+		log.Println("run: reconcile is disabled in the config file, no reconcile interval")
 	}
 
 	// step: long running process
@@ -157,68 +224,84 @@ listenerloop:
 			break listenerloop
 			// return
 		case err := <-retErrChUnseal:
-			log.Printf("run: error received from the vaultUnseal worker: %v", err)
+			switch e := err.(type) {
+			case *vaultg.UnsealOK:
+				log.Printf("run: %v", e)
+			default:
+				log.Printf("run: error received from the vaultUnseal worker: %v", err)
+			}
 		case err := <-retErrChInit:
 			log.Printf("run: error received from the vaultInit worker: %v", err)
+		case err := <-retErrChConfigure:
+			log.Printf("run: error received from the vaultConfigure worker: %v", err)
+		case err := <-retErrChReconcile:
+			log.Printf("run: error received from the vaultReconcile worker: %v", err)
+		case res := <-initCh:
+			log.Printf("run: cluster %v has been initialized through %v", res.Cluster, res.Node)
+			if vgconf.GuardConfig.Unseal {
+				unsealKeyCh <- vaultg.UnsealKeys{Cluster: res.Cluster, Keys: res.Keys}
+			}
+			if configure {
+				configureInitCh <- res
+			}
 			// ECS channels
 		}
 	}
 
 }
 
-func runEcsDsc(srvconfig DbgConfig, vgconf vaultg.Config) map[string][]string {
+// runDsc discovers the vault nodes of every endpoint through the discoverer of its type.
+// The clusters that could not be discovered are left out of the map, their faults are returned.
+func runDsc(srvconfig DbgConfig, vgconf vaultg.Config) (map[string][]string, []error) {
 
-	log.Println("ecsw: running ECS discovery")
+	log.Println("dsc: running discovery")
+	discover.PropagateDebug(debugListenerPtr, debugListenerConf)
 
-	// step: discover vault servers: extract type:ECS vault endpoints
-	var ecscl []ecs.AwsEcsInput
+	// step: discover vault servers: every endpoint is handed to the discoverer of its type
+	rdv := make(map[string][]string)
+	var faults []error
 	for ve := range vgconf.Endpoints {
-		for ves := range vgconf.Endpoints[ve].Specs {
-			var ae ecs.AwsEcsInput
-			ae.Region = vgconf.Endpoints[ve].Specs[ves].Region
-			ae.Cluster = vgconf.Endpoints[ve].Specs[ves].Cluster
-			ecscl = append(ecscl, ae)
+		ep := vgconf.Endpoints[ve]
+		if debugListenerPtr {
+			log.Printf("dsc: config %v endpoints: %v", ep.Type, ep.Specs)
+			if debugListenerConf {
+				spew.Dump(ep.Specs)
+			}
 		}
-	}
-	if debugListenerPtr {
-		// for ve := range vgconf.Endpoints {
-		log.Printf("config ECS clusters: %v", ecscl)
-		// }
-		if debugListenerConf {
-			spew.Dump(ecscl)
+		d, err := discover.Lookup(ep.Type)
+		if err != nil {
+			log.Printf("listener: %v", err)
+			faults = append(faults, err)
+			continue
 		}
-	}
-
-	// step: discover vault servers: pass all ECS endpoints to the ecs pkg for processing
-	ecs.PropagateDebug(debugListenerPtr, debugListenerConf)
-	dsc := ecs.Discover(ecscl)
 
-	// step: log partial failures
-	rdv := make(map[string][]string)
-	var dvs []string
-	for i := range dsc {
-
-		if len(dsc[i].Fault) != 0 {
-			for j := range dsc[i].Fault {
-				errm := fmt.Sprintf("listener: cluster discovery error (%v) for cluster: %v", dsc[i].Fault[j], dsc[i].Cluster)
-				log.Printf(errm)
+		// step: log partial failures
+		for _, res := range d.Discover(ep.Specs) {
+			if len(res.Fault) != 0 {
+				for j := range res.Fault {
+					errm := fmt.Sprintf("listener: cluster discovery error (%v) for cluster: %v", res.Fault[j], res.Cluster)
+					log.Println(errm)
+					fm := fmt.Sprintf("cluster %v: %v", res.Cluster, res.Fault[j])
+					faults = append(faults, errors.New(fm))
+				}
+				continue
 			}
 			// step: return successful discoveries
-		} else {
-			for j := range dsc[i].VaultServers {
-				ts := fmt.Sprintf("https://%v:%v", dsc[i].VaultServers[j].IP, dsc[i].VaultServers[j].Port)
-				dvs = append(dvs, ts)
+			vaultg.RegisterNodes(res.Nodes)
+			var dvs []string
+			for _, n := range res.Nodes {
+				dvs = append(dvs, n.Address)
 			}
-			rdv[dsc[i].Cluster] = dvs
+			rdv[res.Cluster] = dvs
 		}
 	}
 
-	return rdv
+	return rdv, faults
 
 }
 
 // runHTTPSrv starts the HTTP server
-func runHTTPSrv(ctx context.Context, srvConfig DbgConfig, vaultg vaultg.Config, wg *sync.WaitGroup, id workerID) {
+func runHTTPSrv(ctx context.Context, srvConfig DbgConfig, vaultg vaultg.Config, kc *vaultg.KeyCeremony, status *vaultg.Status, wg *sync.WaitGroup, id workerID) {
 
 	defer wg.Done()
 	defer log.Printf("%v%v: gracefully stopped.", id.Name, id.ID)
@@ -226,15 +309,32 @@ func runHTTPSrv(ctx context.Context, srvConfig DbgConfig, vaultg vaultg.Config,
 	addr := vaultg.Address + ":" + vaultg.Port
 	logger := log.New(os.Stdout, "", log.Ldate|log.Lshortfile)
 
+	options := []func(*server.Server){server.Logger(logger), server.StatusReporter("vault", status)}
+	if kc != nil {
+		tokens, err := vaultg.CeremonyTokens()
+		ttl, terr := vaultg.CeremonyShareTTL()
+		if err != nil || terr != nil {
+			logger.Printf("%v%v: key ceremony disabled: %v %v", id.Name, id.ID, err, terr)
+		} else {
+			options = append(options, server.KeyCeremony(kc, tokens, ttl))
+		}
+	}
+
 	hs := &http.Server{
 		Addr:    addr,
-		Handler: server.New(server.Logger(logger)),
+		Handler: server.New(options...),
 	}
 
 	go func() {
 		logger.Printf("%v%v: server is listening on %v", id.Name, id.ID, hs.Addr)
 
-		if err := hs.ListenAndServe(); err != nil {
+		var err error
+		if vaultg.TLSCert != "" {
+			err = hs.ListenAndServeTLS(vaultg.TLSCert, vaultg.TLSKey)
+		} else {
+			err = hs.ListenAndServe()
+		}
+		if err != nil {
 			logger.Printf("%v%v: received an error: %v", id.Name, id.ID, err)
 		}
 	}()
@@ -0,0 +1,81 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	vaultg "github.com/stefancocora/vaultguard/pkg/vault"
+)
+
+// PlanTokenEnv is the env var the plan reads its vault token from
+const PlanTokenEnv = "VAULT_TOKEN"
+
+// Plan discovers the vault clusters, writes the plan of every one of them to w and reports if any has drifted
+func Plan(srvConfig DbgConfig, w io.Writer) (bool, error) {
+	debugListenerPtr = srvConfig.Debug
+	debugListenerConf = srvConfig.DebugConfig
+
+	var vgconf vaultg.Config
+	if err := vgconf.New(); err != nil {
+		return false, err
+	}
+	vaultg.PropagateDebug(srvConfig.Debug, srvConfig.DebugConfig)
+
+	token := os.Getenv(PlanTokenEnv)
+	if token == "" {
+		return false, errors.New("plan: " + PlanTokenEnv + " must hold a vault token that can read sys/mounts, sys/policy, sys/auth and sys/audit")
+	}
+
+	// step: a cluster that can't be discovered can't be planned, which must fail the plan rather than look clean
+	dv, faults := runDsc(srvConfig, vgconf)
+	if len(dv) == 0 && len(faults) == 0 {
+		return false, errors.New("plan: no vault clusters discovered")
+	}
+
+	drift := false
+	var failed []string
+	for _, p := range vaultg.Plan(context.Background(), vgconf, dv, token) {
+		p.Write(w)
+		if p.Err != nil {
+			failed = append(failed, p.Cluster)
+		}
+		if p.Drift() {
+			drift = true
+		}
+	}
+	if debugListenerPtr {
+		log.Printf("plan: drift detected: %v", drift)
+	}
+	if len(faults) != 0 {
+		var fs []string
+		for _, f := range faults {
+			fs = append(fs, f.Error())
+		}
+		errm := fmt.Sprintf("plan: unable to discover every vault cluster: %v", strings.Join(fs, "; "))
+		return drift, errors.New(errm)
+	}
+	if len(failed) != 0 {
+		errm := fmt.Sprintf("plan: unable to read the live state of clusters %v", failed)
+		return drift, errors.New(errm)
+	}
+
+	return drift, nil
+}
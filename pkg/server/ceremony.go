@@ -0,0 +1,372 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stefancocora/vaultguard/pkg/secret"
+)
+
+const (
+	// DefaultShareTTL is how long submitted key shares are kept when the ceremony doesn't complete
+	DefaultShareTTL = 15 * time.Minute
+	// how long the fan out of a complete set of shares to the vault nodes may take
+	ceremonyUnsealTimeout = 2 * time.Minute
+	maxShareBody          = 4096
+)
+
+// Unsealer submits key shares to the vault nodes known to the discovery layer
+type Unsealer interface {
+	// Threshold returns the number of key shares needed to unseal a cluster
+	Threshold(ctx context.Context, cluster string) (int, error)
+	// Unseal submits the key shares to every sealed node of a cluster and returns the result per node, nil meaning unsealed.
+	// The caller zeroes the shares once it returns.
+	Unseal(ctx context.Context, cluster string, keys [][]byte) map[string]error
+}
+
+// ceremony holds the key shares custodians submitted, only in memory and only until they expire
+type ceremony struct {
+	mu       sync.Mutex
+	unsealer Unsealer
+	// tokens maps the sha256 of a custodian token to the custodian name
+	tokens  map[[sha256.Size]byte]string
+	ttl     time.Duration
+	pending map[string]*pendingShares
+}
+
+// pendingShares are the shares submitted for a single cluster
+type pendingShares struct {
+	// shares maps a custodian name to the share it submitted
+	shares  map[string][]byte
+	expires time.Time
+	timer   *time.Timer
+}
+
+// shareRequest is the body custodians submit a share with, the key stays raw JSON so it never becomes a string
+type shareRequest struct {
+	Key json.RawMessage `json:"key"`
+}
+
+// ceremonyStatus is the body of every key ceremony response, it never contains shares
+type ceremonyStatus struct {
+	Cluster    string            `json:"cluster"`
+	Submitted  int               `json:"submitted"`
+	Threshold  int               `json:"threshold,omitempty"`
+	Custodians []string          `json:"custodians,omitempty"`
+	Expires    string            `json:"expires,omitempty"`
+	Nodes      map[string]string `json:"nodes,omitempty"`
+}
+
+// KeyCeremony enables the /ceremony/<cluster> endpoints where the custodians in tokens (name to bearer token)
+// submit unseal key shares. Shares expire after ttl unless the threshold is reached first.
+func KeyCeremony(u Unsealer, tokens map[string]string, ttl time.Duration) func(*Server) {
+	return func(s *Server) {
+		if ttl <= 0 {
+			ttl = DefaultShareTTL
+		}
+		c := &ceremony{
+			unsealer: u,
+			tokens:   make(map[[sha256.Size]byte]string),
+			ttl:      ttl,
+			pending:  make(map[string]*pendingShares),
+		}
+		for name, tok := range tokens {
+			c.tokens[sha256.Sum256([]byte(tok))] = name
+		}
+		s.ceremony = c
+	}
+}
+
+// custodian returns the name of the custodian the request bearer token belongs to
+func (c *ceremony) custodian(req *http.Request) (string, bool) {
+
+	h := req.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(strings.TrimPrefix(h, "Bearer ")))
+
+	// step: compare against every token so the time taken doesn't depend on which one matches
+	var name string
+	for k, v := range c.tokens {
+		if subtle.ConstantTimeCompare(k[:], sum[:]) == 1 {
+			name = v
+		}
+	}
+
+	return name, name != ""
+}
+
+// add stores a share and returns the shares of the cluster once there are threshold of them.
+// The returned shares are no longer held by the ceremony.
+func (c *ceremony) add(cluster string, custodian string, share []byte, threshold int) (*pendingShares, ceremonyStatus, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pending[cluster]
+	if !ok {
+		p = &pendingShares{
+			shares:  make(map[string][]byte),
+			expires: time.Now().Add(c.ttl),
+		}
+		p.timer = time.AfterFunc(c.ttl, func() { c.expire(cluster, p) })
+		c.pending[cluster] = p
+	}
+	for name, s := range p.shares {
+		if name != custodian && subtle.ConstantTimeCompare(s, share) == 1 {
+			secret.Zero(share)
+			return nil, p.status(cluster, threshold), false
+		}
+	}
+	if old, ok := p.shares[custodian]; ok {
+		secret.Zero(old)
+	}
+	p.shares[custodian] = share
+
+	st := p.status(cluster, threshold)
+	if threshold > 0 && len(p.shares) >= threshold {
+		p.timer.Stop()
+		delete(c.pending, cluster)
+		return p, st, true
+	}
+
+	return nil, st, true
+}
+
+// expire drops the shares of a cluster that didn't reach the threshold in time
+func (c *ceremony) expire(cluster string, p *pendingShares) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending[cluster] != p {
+		return
+	}
+	delete(c.pending, cluster)
+	p.zero()
+}
+
+// discard drops the shares of a cluster on request
+func (c *ceremony) discard(cluster string) int {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pending[cluster]
+	if !ok {
+		return 0
+	}
+	p.timer.Stop()
+	delete(c.pending, cluster)
+	n := len(p.shares)
+	p.zero()
+
+	return n
+}
+
+// status returns the progress of the ceremony of a cluster
+func (c *ceremony) status(cluster string, threshold int) ceremonyStatus {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pending[cluster]
+	if !ok {
+		return ceremonyStatus{Cluster: cluster, Threshold: threshold}
+	}
+
+	return p.status(cluster, threshold)
+}
+
+func (p *pendingShares) status(cluster string, threshold int) ceremonyStatus {
+
+	st := ceremonyStatus{
+		Cluster:   cluster,
+		Submitted: len(p.shares),
+		Threshold: threshold,
+		Expires:   p.expires.UTC().Format(time.RFC3339),
+	}
+	for name := range p.shares {
+		st.Custodians = append(st.Custodians, name)
+	}
+	sort.Strings(st.Custodians)
+
+	return st
+}
+
+// keys returns the shares ordered by custodian name, they share their memory with p so p.zero wipes them too
+func (p *pendingShares) keys() [][]byte {
+
+	var names []string
+	for name := range p.shares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var keys [][]byte
+	for _, name := range names {
+		keys = append(keys, p.shares[name])
+	}
+
+	return keys
+}
+
+// zero overwrites the shares
+func (p *pendingShares) zero() {
+	for name := range p.shares {
+		secret.Zero(p.shares[name])
+		delete(p.shares, name)
+	}
+}
+
+// keyCeremony lets custodians submit key shares for a named cluster
+// GET returns the progress, PUT submits a share as {"key": "<share>"}, DELETE discards the submitted shares
+func (s *Server) keyCeremony(res http.ResponseWriter, req *http.Request) {
+
+	c := s.ceremony
+	custodian, ok := c.custodian(req)
+	if !ok {
+		res.Header().Set("WWW-Authenticate", `Bearer realm="vaultguard"`)
+		http.Error(res, "a valid custodian token is required", http.StatusUnauthorized)
+		s.logger.Printf("%v %v %v %v %v", req.RemoteAddr, req.Method, req.URL.Path, req.Proto, http.StatusUnauthorized)
+		return
+	}
+
+	cluster := strings.TrimPrefix(req.URL.Path, "/ceremony/")
+	if cluster == "" || strings.Contains(cluster, "/") {
+		http.NotFound(res, req)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		t, err := c.unsealer.Threshold(req.Context(), cluster)
+		if err != nil {
+			s.logger.Printf("ceremony: unable to read the threshold of cluster %v: %v", cluster, err)
+		}
+		s.writeCeremony(res, req, http.StatusOK, c.status(cluster, t))
+	case "PUT":
+		s.submitShare(res, req, custodian, cluster)
+	case "DELETE":
+		n := c.discard(cluster)
+		s.logger.Printf("ceremony: custodian %v discarded %v key shares of cluster %v", custodian, n, cluster)
+		s.writeCeremony(res, req, http.StatusOK, ceremonyStatus{Cluster: cluster})
+	default:
+		http.Error(res, "Only GET, PUT and DELETE are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// submitShare adds the share of a custodian and unseals the cluster once the threshold is reached
+func (s *Server) submitShare(res http.ResponseWriter, req *http.Request, custodian string, cluster string) {
+
+	c := s.ceremony
+
+	share, ok := readShare(req.Body)
+	if !ok {
+		http.Error(res, `the body must be {"key": "<unseal key share>"}`, http.StatusBadRequest)
+		s.logger.Printf("%v %v %v %v %v", req.RemoteAddr, req.Method, req.URL.Path, req.Proto, http.StatusBadRequest)
+		return
+	}
+
+	// step: the threshold is read from the cluster itself so a share is never accepted for an unknown cluster
+	t, err := c.unsealer.Threshold(req.Context(), cluster)
+	if err != nil {
+		secret.Zero(share)
+		s.logger.Printf("ceremony: unable to read the threshold of cluster %v: %v", cluster, err)
+		http.Error(res, "unable to read the seal status of the cluster", http.StatusBadGateway)
+		return
+	}
+
+	p, st, ok := c.add(cluster, custodian, share, t)
+	if !ok {
+		s.logger.Printf("ceremony: custodian %v submitted a key share of cluster %v already submitted by another custodian", custodian, cluster)
+		s.writeCeremony(res, req, http.StatusConflict, st)
+		return
+	}
+	s.logger.Printf("ceremony: custodian %v submitted a key share of cluster %v (%v/%v)", custodian, cluster, st.Submitted, t)
+	if p == nil {
+		s.writeCeremony(res, req, http.StatusAccepted, st)
+		return
+	}
+
+	// step: threshold reached, fan the shares out to the sealed nodes and forget them whatever the outcome
+	ctx, cancel := context.WithTimeout(context.Background(), ceremonyUnsealTimeout)
+	defer cancel()
+	defer p.zero()
+	results := c.unsealer.Unseal(ctx, cluster, p.keys())
+
+	st.Expires = ""
+	st.Nodes = make(map[string]string)
+	stc := http.StatusOK
+	for node, err := range results {
+		if err != nil {
+			st.Nodes[node] = err.Error()
+			stc = http.StatusBadGateway
+			continue
+		}
+		st.Nodes[node] = "unsealed"
+	}
+	s.logger.Printf("ceremony: key shares of cluster %v submitted to its nodes: %v", cluster, st.Nodes)
+	s.writeCeremony(res, req, stc, st)
+}
+
+// readShare reads the share out of a {"key": "<share>"} body into a buffer of its own, zeroing every other copy.
+// Shares are hex or base64 encoded so a key that needs JSON escapes is rejected rather than unescaped into a string.
+func readShare(body io.Reader) ([]byte, bool) {
+
+	buf, err := ioutil.ReadAll(io.LimitReader(body, maxShareBody))
+	defer secret.Zero(buf)
+	if err != nil {
+		return nil, false
+	}
+
+	var sr shareRequest
+	err = json.Unmarshal(buf, &sr)
+	defer secret.Zero(sr.Key)
+	if err != nil || len(sr.Key) < 2 || sr.Key[0] != '"' || sr.Key[len(sr.Key)-1] != '"' {
+		return nil, false
+	}
+	raw := bytes.TrimSpace(sr.Key[1 : len(sr.Key)-1])
+	if len(raw) == 0 || bytes.IndexByte(raw, '\\') != -1 {
+		return nil, false
+	}
+
+	share := make([]byte, len(raw))
+	copy(share, raw)
+
+	return share, true
+}
+
+func (s *Server) writeCeremony(res http.ResponseWriter, req *http.Request, stc int, st ceremonyStatus) {
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(stc)
+	if err := json.NewEncoder(res).Encode(st); err != nil {
+		s.logger.Printf("ceremony: unable to write the response: %v", err)
+	}
+	s.logger.Printf("%v %v %v %v %v", req.RemoteAddr, req.Method, req.URL.Path, req.Proto, stc)
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUnsealer reports a threshold for the known clusters and records the shares it is asked to submit
+type fakeUnsealer struct {
+	mu        sync.Mutex
+	threshold map[string]int
+	results   map[string]error
+	// submitted holds copies of the shares, held keeps the slices themselves to check they are zeroed afterwards
+	submitted [][]string
+	held      [][]byte
+}
+
+func (f *fakeUnsealer) Threshold(ctx context.Context, cluster string) (int, error) {
+	t, ok := f.threshold[cluster]
+	if !ok {
+		return 0, errors.New("unknown cluster")
+	}
+	return t, nil
+}
+
+func (f *fakeUnsealer) Unseal(ctx context.Context, cluster string, keys [][]byte) map[string]error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var s []string
+	for _, k := range keys {
+		s = append(s, string(k))
+		f.held = append(f.held, k)
+	}
+	f.submitted = append(f.submitted, s)
+	return f.results
+}
+
+var custodianTokens = map[string]string{"alice": "token-alice", "bob": "token-bob", "carol": "token-carol"}
+
+func newCeremonyServer(u Unsealer, ttl time.Duration) *httptest.Server {
+	s := New(Logger(log.New(ioutil.Discard, "", 0)), KeyCeremony(u, custodianTokens, ttl))
+	return httptest.NewServer(s)
+}
+
+// ceremonyCall sends a request to the key ceremony endpoint of a cluster
+func ceremonyCall(t *testing.T, srv *httptest.Server, method, cluster, token, body string) (int, ceremonyStatus) {
+
+	req, err := http.NewRequest(method, srv.URL+"/ceremony/"+cluster, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var st ceremonyStatus
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return resp.StatusCode, st
+}
+
+func TestCeremonyAuth(t *testing.T) {
+
+	srv := newCeremonyServer(&fakeUnsealer{threshold: map[string]int{"prod": 2}}, time.Minute)
+	defer srv.Close()
+
+	cases := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		code   int
+	}{
+		{name: "no token", method: "GET", code: http.StatusUnauthorized},
+		{name: "unknown token", method: "PUT", token: "token-mallory", body: `{"key": "aabb"}`, code: http.StatusUnauthorized},
+		{name: "token prefix", method: "GET", token: "token-ali", code: http.StatusUnauthorized},
+		{name: "valid token", method: "GET", token: "token-alice", code: http.StatusOK},
+		{name: "not json", method: "PUT", token: "token-alice", body: `aabb`, code: http.StatusBadRequest},
+		{name: "empty key", method: "PUT", token: "token-alice", body: `{"key": " "}`, code: http.StatusBadRequest},
+		{name: "escaped key", method: "PUT", token: "token-alice", body: `{"key": "aa\u0062b"}`, code: http.StatusBadRequest},
+		{name: "key not a string", method: "PUT", token: "token-alice", body: `{"key": 12}`, code: http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		code, st := ceremonyCall(t, srv, tc.method, "prod", tc.token, tc.body)
+		if code != tc.code {
+			t.Errorf("%v: expected status %v, got %v", tc.name, tc.code, code)
+		}
+		if st.Submitted != 0 {
+			t.Errorf("%v: expected no share to be held, got %v", tc.name, st.Submitted)
+		}
+	}
+
+	code, _ := ceremonyCall(t, srv, "PUT", "unknown", "token-alice", `{"key": "aabb"}`)
+	if code != http.StatusBadGateway {
+		t.Errorf("share for an unknown cluster: expected status %v, got %v", http.StatusBadGateway, code)
+	}
+}
+
+func TestCeremonyExpiry(t *testing.T) {
+
+	srv := newCeremonyServer(&fakeUnsealer{threshold: map[string]int{"prod": 3}}, 50*time.Millisecond)
+	defer srv.Close()
+
+	code, st := ceremonyCall(t, srv, "PUT", "prod", "token-alice", `{"key": "aabb"}`)
+	if code != http.StatusAccepted || st.Submitted != 1 {
+		t.Fatalf("expected the share to be accepted, got %v %+v", code, st)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	code, st = ceremonyCall(t, srv, "GET", "prod", "token-bob", "")
+	if code != http.StatusOK || st.Submitted != 0 || st.Expires != "" {
+		t.Errorf("expected the shares to have expired, got %v %+v", code, st)
+	}
+}
+
+func TestCeremonyDuplicateShare(t *testing.T) {
+
+	srv := newCeremonyServer(&fakeUnsealer{threshold: map[string]int{"prod": 3}}, time.Minute)
+	defer srv.Close()
+
+	if code, _ := ceremonyCall(t, srv, "PUT", "prod", "token-alice", `{"key": "aabb"}`); code != http.StatusAccepted {
+		t.Fatalf("expected the first share to be accepted, got %v", code)
+	}
+	code, st := ceremonyCall(t, srv, "PUT", "prod", "token-bob", `{"key": "aabb"}`)
+	if code != http.StatusConflict || st.Submitted != 1 {
+		t.Errorf("expected the share of another custodian to be rejected, got %v %+v", code, st)
+	}
+	// step: a custodian may replace its own share
+	code, st = ceremonyCall(t, srv, "PUT", "prod", "token-alice", `{"key": "aabb"}`)
+	if code != http.StatusAccepted || st.Submitted != 1 {
+		t.Errorf("expected the custodian to resubmit its share, got %v %+v", code, st)
+	}
+	code, st = ceremonyCall(t, srv, "DELETE", "prod", "token-bob", "")
+	if code != http.StatusOK || st.Submitted != 0 {
+		t.Errorf("expected the shares to be discarded, got %v %+v", code, st)
+	}
+	if code, st = ceremonyCall(t, srv, "GET", "prod", "token-bob", ""); st.Submitted != 0 {
+		t.Errorf("expected no shares after discard, got %v %+v", code, st)
+	}
+}
+
+func TestCeremonyThreshold(t *testing.T) {
+
+	u := &fakeUnsealer{
+		threshold: map[string]int{"prod": 2},
+		results:   map[string]error{"https://10.0.0.1:8200": nil, "https://10.0.0.2:8200": errors.New("connection refused")},
+	}
+	srv := newCeremonyServer(u, time.Minute)
+	defer srv.Close()
+
+	if code, _ := ceremonyCall(t, srv, "PUT", "prod", "token-bob", `{"key": "bbbb"}`); code != http.StatusAccepted {
+		t.Fatalf("expected the first share to be accepted, got %v", code)
+	}
+	if len(u.submitted) != 0 {
+		t.Fatalf("shares were submitted before the threshold was reached")
+	}
+
+	code, st := ceremonyCall(t, srv, "PUT", "prod", "token-alice", `{"key": " aaaa "}`)
+	if code != http.StatusBadGateway {
+		t.Errorf("expected a node failure to be reported, got %v", code)
+	}
+	if st.Nodes["https://10.0.0.1:8200"] != "unsealed" || st.Nodes["https://10.0.0.2:8200"] != "connection refused" {
+		t.Errorf("unexpected node results %v", st.Nodes)
+	}
+
+	// step: the shares are submitted once, in custodian order, and zeroed afterwards
+	if len(u.submitted) != 1 || strings.Join(u.submitted[0], ",") != "aaaa,bbbb" {
+		t.Fatalf("unexpected submitted shares %v", u.submitted)
+	}
+	for _, k := range u.held {
+		for _, b := range k {
+			if b != 0 {
+				t.Fatalf("share %q was not zeroed after the unseal", k)
+			}
+		}
+	}
+
+	if code, st = ceremonyCall(t, srv, "GET", "prod", "token-alice", ""); st.Submitted != 0 {
+		t.Errorf("expected the ceremony to start over, got %v %+v", code, st)
+	}
+}
@@ -14,6 +14,7 @@ limitations under the License.
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -24,8 +25,17 @@ var debugSrvPtr bool
 
 // Server is the struct representing the state in rAM of a running server
 type Server struct {
-	logger *log.Logger
-	mux    *http.ServeMux
+	logger   *log.Logger
+	mux      *http.ServeMux
+	ceremony *ceremony
+	// reporters supply the sections of the /status output
+	reporters map[string]Reporter
+}
+
+// Reporter supplies a section of the /status output
+type Reporter interface {
+	// Report returns the section, it is encoded as JSON
+	Report() interface{}
 }
 
 // New creates an instance of a mux server
@@ -44,6 +54,9 @@ func New(options ...func(*Server)) *Server {
 	s.mux.HandleFunc("/healthz", s.healthz)
 	s.mux.HandleFunc("/status", s.status)
 	s.mux.HandleFunc("/pausewatch", s.pausewatch)
+	if s.ceremony != nil {
+		s.mux.HandleFunc("/ceremony/", s.keyCeremony)
+	}
 
 	return s
 }
@@ -62,6 +75,16 @@ func Logger(logger *log.Logger) func(*Server) {
 	}
 }
 
+// StatusReporter adds the section name to the /status output
+func StatusReporter(name string, r Reporter) func(*Server) {
+	return func(s *Server) {
+		if s.reporters == nil {
+			s.reporters = make(map[string]Reporter)
+		}
+		s.reporters[name] = r
+	}
+}
+
 // HTTP handlers
 
 func (s *Server) healthz(res http.ResponseWriter, req *http.Request) {
@@ -86,8 +109,23 @@ func (s *Server) status(res http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
 		stc := http.StatusOK
+		if len(s.reporters) == 0 {
+			res.WriteHeader(stc)
+			fmt.Fprint(res, "status: doing nothing for now")
+			s.logger.Printf("%v %v %v %v %v", req.RemoteAddr, req.Method, req.URL.Path, req.Proto, stc)
+			return
+		}
+		st := make(map[string]interface{})
+		for name, r := range s.reporters {
+			st[name] = r.Report()
+		}
+		res.Header().Set("Content-Type", "application/json")
 		res.WriteHeader(stc)
-		fmt.Fprint(res, "status: doing nothing for now")
+		enc := json.NewEncoder(res)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(st); err != nil {
+			s.logger.Printf("status: unable to write the response: %v", err)
+		}
 		s.logger.Printf("%v %v %v %v %v", req.RemoteAddr, req.Method, req.URL.Path, req.Proto, stc)
 	default:
 		http.Error(res, "Only GET is allowed", http.StatusMethodNotAllowed)
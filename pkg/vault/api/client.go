@@ -0,0 +1,315 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var dbgAPIPkg bool
+
+const (
+	defaultTimeout   = 10 * time.Second
+	defaultRetryWait = 1 * time.Second
+)
+
+// Config contains the settings needed to talk to a single vault node
+type Config struct {
+	// Address is the vault node base URL, eg https://10.0.0.1:8200
+	Address string
+	// CACert is the path to a PEM encoded CA bundle used to verify the vault node certificate
+	CACert string
+	// TLSServerName is the name the vault node certificate is verified against when it differs from the address host
+	TLSServerName string
+	// Timeout is the per request timeout
+	Timeout time.Duration
+	// MaxRetries is the number of times a failed request will be retried
+	MaxRetries int
+	// RetryWait is the base wait between retries, it grows linearly with every attempt
+	RetryWait time.Duration
+	// Token is the vault token sent with every request
+	Token string
+}
+
+// Client is a minimal typed client for the vault HTTP API
+type Client struct {
+	addr       string
+	token      string
+	maxRetries int
+	retryWait  time.Duration
+	// retryWrites lets the writes of an idempotent() copy be retried like the reads
+	retryWrites bool
+	hc          *http.Client
+}
+
+// APIError is returned when vault answers with a non successful status code.
+// Callers can use Temporary() to decide if the request is worth retrying.
+type APIError struct {
+	StatusCode int
+	Method     string
+	Path       string
+	Errors     []string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("vault: %v %v returned %v: %v", e.Method, e.Path, e.StatusCode, strings.Join(e.Errors, ", "))
+}
+
+// Temporary reports if the error is likely to go away if the request is retried
+func (e *APIError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// IsNotFound reports if err is a vault 404 response
+func IsNotFound(err error) bool {
+	if aerr, ok := err.(*APIError); ok {
+		return aerr.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// New creates a vault API client from the given Config
+func New(c Config) (*Client, error) {
+
+	if c.Address == "" {
+		return nil, errors.New("vault api: missing vault address")
+	}
+	u, err := url.Parse(c.Address)
+	if err != nil {
+		errm := fmt.Sprintf("vault api: invalid vault address %v: %v", c.Address, err)
+		return nil, errors.New(errm)
+	}
+
+	tlsc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.TLSServerName,
+	}
+	if c.CACert != "" {
+		pem, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			errm := fmt.Sprintf("vault api: unable to read CA certificate %v: %v", c.CACert, err)
+			return nil, errors.New(errm)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			errm := fmt.Sprintf("vault api: no PEM certificates found in %v", c.CACert)
+			return nil, errors.New(errm)
+		}
+		tlsc.RootCAs = pool
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.RetryWait == 0 {
+		c.RetryWait = defaultRetryWait
+	}
+
+	cl := &Client{
+		addr:       strings.TrimSuffix(u.String(), "/"),
+		token:      c.Token,
+		maxRetries: c.MaxRetries,
+		retryWait:  c.RetryWait,
+		hc: &http.Client{
+			Timeout: c.Timeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     tlsc,
+				TLSHandshakeTimeout: c.Timeout,
+			},
+		},
+	}
+
+	return cl, nil
+}
+
+// Address returns the vault node address this client talks to
+func (c *Client) Address() string {
+	return c.addr
+}
+
+// WithToken returns a copy of the client that authenticates with the given token.
+// The underlying HTTP client is shared.
+func (c *Client) WithToken(token string) *Client {
+	cp := *c
+	cp.token = token
+	return &cp
+}
+
+// idempotent returns a copy of the client whose writes are retried, for the requests vault applies idempotently.
+// Writes are otherwise sent once as a retry after a lost response may apply them twice, eg rotate a key or mint a CA.
+func (c *Client) idempotent() *Client {
+	cp := *c
+	cp.retryWrites = true
+	return &cp
+}
+
+// do sends a request to vault and decodes the JSON response into out, when out is not nil
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+
+	var body []byte
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			errm := fmt.Sprintf("vault api: unable to encode request for %v: %v", path, err)
+			return errors.New(errm)
+		}
+		body = b
+	}
+
+	return c.doBody(ctx, method, path, body, out)
+}
+
+// doBody sends an already encoded request body to vault and decodes the JSON response into out, when out is not nil
+func (c *Client) doBody(ctx context.Context, method, path string, body []byte, out interface{}) error {
+
+	rb, err := c.roundTrip(ctx, method, path, body, isSuccess)
+	if err != nil {
+		return err
+	}
+	if out == nil || len(rb) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(rb, out); err != nil {
+		errm := fmt.Sprintf("vault api: unable to decode response from %v: %v", path, err)
+		return errors.New(errm)
+	}
+
+	return nil
+}
+
+// roundTrip sends a request until vault answers with a status accepted by ok.
+// Transport errors and temporary API errors of reads and idempotent writes are retried up to maxRetries times.
+func (c *Client) roundTrip(ctx context.Context, method, path string, body []byte, ok func(int) bool) ([]byte, error) {
+
+	retries := c.maxRetries
+	if method != "GET" && method != "LIST" && !c.retryWrites {
+		retries = 0
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			if dbgAPIPkg {
+				log.Printf("vault api: retrying %v %v/v1/%v, attempt %v: %v", method, c.addr, path, attempt, lastErr)
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(attempt) * c.retryWait):
+			}
+		}
+
+		status, rb, err := c.send(ctx, method, path, body)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if ok(status) {
+			return rb, nil
+		}
+
+		aerr := &APIError{
+			StatusCode: status,
+			Method:     method,
+			Path:       path,
+			Errors:     decodeErrors(rb),
+		}
+		if !aerr.Temporary() {
+			return nil, aerr
+		}
+		lastErr = aerr
+	}
+
+	return nil, lastErr
+}
+
+func isSuccess(status int) bool {
+	return status >= 200 && status <= 299
+}
+
+// send performs a single HTTP round trip and returns the status code and the raw body
+func (c *Client) send(ctx context.Context, method, path string, body []byte) (int, []byte, error) {
+
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.addr+"/v1/"+strings.TrimPrefix(path, "/"), rd)
+	if err != nil {
+		return 0, nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	rb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if dbgAPIPkg {
+		log.Printf("vault api: %v %v/v1/%v returned %v", method, c.addr, path, resp.StatusCode)
+	}
+
+	return resp.StatusCode, rb, nil
+}
+
+// decodeErrors extracts the errors array that vault sends back on failures
+func decodeErrors(b []byte) []string {
+	var e struct {
+		Errors []string `json:"errors"`
+	}
+	if err := json.Unmarshal(b, &e); err != nil || len(e.Errors) == 0 {
+		if len(b) == 0 {
+			return nil
+		}
+		return []string{strings.TrimSpace(string(b))}
+	}
+	return e.Errors
+}
+
+// PropagateDebug propagates the debug flag from main into this pkg, when explicitly called
+func PropagateDebug(dbg bool) {
+	dbgAPIPkg = dbg
+}
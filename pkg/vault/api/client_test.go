@@ -0,0 +1,216 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first fail requests with status, then answers 200
+type flakyServer struct {
+	mu       sync.Mutex
+	fail     int
+	status   int
+	requests int
+}
+
+func (f *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if f.requests <= f.fail {
+		w.WriteHeader(f.status)
+		w.Write([]byte(`{"errors":["try again"]}`))
+		return
+	}
+	w.Write([]byte(`{"keys":["a"]}`))
+}
+
+func testClient(t *testing.T, addr string) *Client {
+	c, err := New(Config{Address: addr, MaxRetries: 2, RetryWait: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRetry(t *testing.T) {
+
+	cases := []struct {
+		name     string
+		status   int
+		fail     int
+		call     func(*Client) error
+		requests int
+		ok       bool
+	}{
+		{
+			name: "read retried on 502", status: http.StatusBadGateway, fail: 2, requests: 3, ok: true,
+			call: func(c *Client) error { _, err := c.Read(context.Background(), "secret/a"); return err },
+		},
+		{
+			name: "list retried on 500", status: http.StatusInternalServerError, fail: 1, requests: 2, ok: true,
+			call: func(c *Client) error { _, err := c.List(context.Background(), "secret/"); return err },
+		},
+		{
+			name: "read gives up after max retries", status: http.StatusGatewayTimeout, fail: 5, requests: 3,
+			call: func(c *Client) error { _, err := c.Read(context.Background(), "secret/a"); return err },
+		},
+		{
+			name: "read not retried on 403", status: http.StatusForbidden, fail: 1, requests: 1,
+			call: func(c *Client) error { _, err := c.Read(context.Background(), "secret/a"); return err },
+		},
+		{
+			name: "mount not retried on 502", status: http.StatusBadGateway, fail: 1, requests: 1,
+			call: func(c *Client) error { return c.Mount(context.Background(), "kv", &MountInput{Type: "kv"}) },
+		},
+		{
+			name: "write not retried on 502", status: http.StatusBadGateway, fail: 1, requests: 1,
+			call: func(c *Client) error {
+				_, err := c.Write(context.Background(), "transit/keys/k/rotate", nil)
+				return err
+			},
+		},
+		{
+			name: "policy put retried on 502", status: http.StatusBadGateway, fail: 1, requests: 2, ok: true,
+			call: func(c *Client) error { return c.PutPolicy(context.Background(), "p", `path "a" { policy = "read" }`) },
+		},
+	}
+	for _, tc := range cases {
+		f := &flakyServer{fail: tc.fail, status: tc.status}
+		srv := httptest.NewServer(f)
+		err := tc.call(testClient(t, srv.URL))
+		srv.Close()
+		if tc.ok && err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%v: expected an error", tc.name)
+		}
+		if f.requests != tc.requests {
+			t.Errorf("%v: expected %v requests, got %v", tc.name, tc.requests, f.requests)
+		}
+	}
+}
+
+func TestRetryTransportError(t *testing.T) {
+
+	// step: a closed server refuses connections
+	srv := httptest.NewServer(http.NotFoundHandler())
+	addr := srv.URL
+	srv.Close()
+
+	c := testClient(t, addr)
+	if _, err := c.Read(context.Background(), "secret/a"); err == nil {
+		t.Errorf("expected a transport error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Read(ctx, "secret/a"); err != context.Canceled {
+		t.Errorf("expected the cancelled context to stop the retries, got %v", err)
+	}
+}
+
+func TestTemporary(t *testing.T) {
+
+	cases := map[int]bool{
+		http.StatusBadRequest:          false,
+		http.StatusForbidden:           false,
+		http.StatusNotFound:            false,
+		http.StatusTooManyRequests:     false,
+		http.StatusInternalServerError: true,
+		http.StatusBadGateway:          true,
+		http.StatusServiceUnavailable:  false,
+		http.StatusGatewayTimeout:      true,
+	}
+	for status, temporary := range cases {
+		e := &APIError{StatusCode: status, Method: "GET", Path: "sys/health"}
+		if e.Temporary() != temporary {
+			t.Errorf("status %v: expected Temporary() %v", status, temporary)
+		}
+	}
+	if !IsNotFound(&APIError{StatusCode: http.StatusNotFound}) || IsNotFound(&APIError{StatusCode: http.StatusBadGateway}) {
+		t.Errorf("IsNotFound misclassified the status codes")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys":["a"]}`))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "vaultguard-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := filepath.Join(dir, "ca.pem")
+	pemb := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, pemb, 0600); err != nil {
+		t.Fatal(err)
+	}
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		c    Config
+		// newErr is set when New itself must fail
+		newErr bool
+		ok     bool
+	}{
+		{name: "no CA", c: Config{Address: srv.URL}},
+		{name: "CA", c: Config{Address: srv.URL, CACert: ca}, ok: true},
+		{name: "CA and matching server name", c: Config{Address: srv.URL, CACert: ca, TLSServerName: "example.com"}, ok: true},
+		{name: "CA and other server name", c: Config{Address: srv.URL, CACert: ca, TLSServerName: "vault.example.org"}},
+		{name: "missing CA file", c: Config{Address: srv.URL, CACert: filepath.Join(dir, "missing.pem")}, newErr: true},
+		{name: "CA file without certificates", c: Config{Address: srv.URL, CACert: notPEM}, newErr: true},
+		{name: "no address", c: Config{}, newErr: true},
+	}
+	for _, tc := range cases {
+		c, err := New(tc.c)
+		if tc.newErr {
+			if err == nil {
+				t.Errorf("%v: expected New to fail", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error from New: %v", tc.name, err)
+			continue
+		}
+		_, err = c.Read(context.Background(), "secret/a")
+		if tc.ok && err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%v: expected the certificate to be rejected", tc.name)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// Secret is the generic response of a logical path read
+type Secret struct {
+	Data          map[string]interface{} `json:"data"`
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+}
+
+// Read reads a logical path and returns its data, a path that doesn't exist returns nil data and no error
+func (c *Client) Read(ctx context.Context, path string) (map[string]interface{}, error) {
+	var r Secret
+	if err := c.do(ctx, "GET", strings.Trim(path, "/"), nil, &r); err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if r.Data == nil {
+		r.Data = make(map[string]interface{})
+	}
+	return r.Data, nil
+}
+
+// Write writes data to a logical path and returns the data of the response, if any
+func (c *Client) Write(ctx context.Context, path string, data map[string]interface{}) (map[string]interface{}, error) {
+	var r Secret
+	if err := c.do(ctx, "PUT", strings.Trim(path, "/"), data, &r); err != nil {
+		return nil, err
+	}
+	return r.Data, nil
+}
+
+// List lists the keys under a logical path, a path without keys returns an empty list and no error
+func (c *Client) List(ctx context.Context, path string) ([]string, error) {
+	var r struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, "LIST", strings.Trim(path, "/"), nil, &r); err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sort.Strings(r.Data.Keys)
+	return r.Data.Keys, nil
+}
+
+// Delete deletes a logical path
+func (c *Client) Delete(ctx context.Context, path string) error {
+	return c.do(ctx, "DELETE", strings.Trim(path, "/"), nil, nil)
+}
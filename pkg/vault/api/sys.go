@@ -0,0 +1,460 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/stefancocora/vaultguard/pkg/secret"
+)
+
+// HealthResponse is the body of sys/health
+type HealthResponse struct {
+	Initialized   bool   `json:"initialized"`
+	Sealed        bool   `json:"sealed"`
+	Standby       bool   `json:"standby"`
+	ServerTimeUTC int64  `json:"server_time_utc"`
+	Version       string `json:"version"`
+	ClusterName   string `json:"cluster_name,omitempty"`
+	ClusterID     string `json:"cluster_id,omitempty"`
+}
+
+// InitRequest is the body sent to sys/init
+type InitRequest struct {
+	SecretShares    int      `json:"secret_shares"`
+	SecretThreshold int      `json:"secret_threshold"`
+	PGPKeys         []string `json:"pgp_keys,omitempty"`
+	RootTokenPGPKey string   `json:"root_token_pgp_key,omitempty"`
+}
+
+// InitResponse is the body returned by sys/init
+type InitResponse struct {
+	Keys      []string `json:"keys"`
+	KeysB64   []string `json:"keys_base64"`
+	RootToken string   `json:"root_token"`
+}
+
+// SealStatusResponse is the body of sys/seal-status and sys/unseal
+type SealStatusResponse struct {
+	Sealed      bool   `json:"sealed"`
+	T           int    `json:"t"`
+	N           int    `json:"n"`
+	Progress    int    `json:"progress"`
+	Nonce       string `json:"nonce"`
+	Version     string `json:"version"`
+	ClusterName string `json:"cluster_name,omitempty"`
+	ClusterID   string `json:"cluster_id,omitempty"`
+}
+
+// LeaderResponse is the body of sys/leader
+type LeaderResponse struct {
+	HAEnabled            bool   `json:"ha_enabled"`
+	IsSelf               bool   `json:"is_self"`
+	LeaderAddress        string `json:"leader_address"`
+	LeaderClusterAddress string `json:"leader_cluster_address"`
+}
+
+// GenerateRootStatus is the body of sys/generate-root/attempt and sys/generate-root/update
+type GenerateRootStatus struct {
+	Started  bool   `json:"started"`
+	Nonce    string `json:"nonce"`
+	Progress int    `json:"progress"`
+	Required int    `json:"required"`
+	Complete bool   `json:"complete"`
+	// EncodedToken is the new root token XORed with the OTP, vault 0.9 renamed the field
+	EncodedToken     string `json:"encoded_token"`
+	EncodedRootToken string `json:"encoded_root_token"`
+	PGPFingerprint   string `json:"pgp_fingerprint"`
+	// OTPLength is set by vault 1.0 and later, which generate the otp themselves and return it in OTP
+	OTPLength int    `json:"otp_length"`
+	OTP       string `json:"otp"`
+}
+
+// Encoded returns the encoded root token whichever field the vault version used
+func (g *GenerateRootStatus) Encoded() string {
+	if g.EncodedToken != "" {
+		return g.EncodedToken
+	}
+	return g.EncodedRootToken
+}
+
+// MountConfig is the tuning config of a mount as vault reports it, TTLs are in seconds
+type MountConfig struct {
+	DefaultLeaseTTL          int      `json:"default_lease_ttl,omitempty"`
+	MaxLeaseTTL              int      `json:"max_lease_ttl,omitempty"`
+	ListingVisibility        string   `json:"listing_visibility,omitempty"`
+	AuditNonHMACRequestKeys  []string `json:"audit_non_hmac_request_keys,omitempty"`
+	AuditNonHMACResponseKeys []string `json:"audit_non_hmac_response_keys,omitempty"`
+}
+
+// MountOutput describes an existing secret backend mount
+type MountOutput struct {
+	Type        string            `json:"type"`
+	Description string            `json:"description"`
+	Config      MountConfig       `json:"config"`
+	Options     map[string]string `json:"options"`
+	Local       bool              `json:"local"`
+	SealWrap    bool              `json:"seal_wrap"`
+}
+
+// MountConfigInput is the tuning config sent along with a new mount, TTLs are durations, eg "1h"
+type MountConfigInput struct {
+	DefaultLeaseTTL          string   `json:"default_lease_ttl,omitempty"`
+	MaxLeaseTTL              string   `json:"max_lease_ttl,omitempty"`
+	ListingVisibility        string   `json:"listing_visibility,omitempty"`
+	AuditNonHMACRequestKeys  []string `json:"audit_non_hmac_request_keys,omitempty"`
+	AuditNonHMACResponseKeys []string `json:"audit_non_hmac_response_keys,omitempty"`
+}
+
+// MountInput is the body sent to sys/mounts/<path> to mount a secret backend
+type MountInput struct {
+	Type        string            `json:"type"`
+	Description string            `json:"description"`
+	Config      MountConfigInput  `json:"config"`
+	Options     map[string]string `json:"options,omitempty"`
+	Local       bool              `json:"local,omitempty"`
+	SealWrap    bool              `json:"seal_wrap,omitempty"`
+}
+
+// MountTuneInput is the body sent to sys/mounts/<path>/tune, unset fields are left alone
+type MountTuneInput struct {
+	Description              *string           `json:"description,omitempty"`
+	DefaultLeaseTTL          string            `json:"default_lease_ttl,omitempty"`
+	MaxLeaseTTL              string            `json:"max_lease_ttl,omitempty"`
+	ListingVisibility        string            `json:"listing_visibility,omitempty"`
+	AuditNonHMACRequestKeys  []string          `json:"audit_non_hmac_request_keys,omitempty"`
+	AuditNonHMACResponseKeys []string          `json:"audit_non_hmac_response_keys,omitempty"`
+	Options                  map[string]string `json:"options,omitempty"`
+}
+
+// AuditDevice describes an audit device, it is both the body sent to sys/audit/<path> and what sys/audit returns
+type AuditDevice struct {
+	Type        string            `json:"type"`
+	Description string            `json:"description"`
+	Options     map[string]string `json:"options"`
+	Local       bool              `json:"local,omitempty"`
+}
+
+// Health reads sys/health.
+// Vault uses non 200 status codes to signal standby, sealed and uninitialized nodes,
+// all of which still carry a valid health body.
+func (c *Client) Health(ctx context.Context) (*HealthResponse, error) {
+
+	ok := func(status int) bool {
+		switch status {
+		case http.StatusOK, http.StatusTooManyRequests, http.StatusNotImplemented, http.StatusServiceUnavailable:
+			return true
+		}
+		return false
+	}
+	rb, err := c.roundTrip(ctx, "GET", "sys/health", nil, ok)
+	if err != nil {
+		return nil, err
+	}
+
+	var h HealthResponse
+	if err := json.Unmarshal(rb, &h); err != nil {
+		errm := fmt.Sprintf("vault api: unable to decode sys/health response: %v", err)
+		return nil, errors.New(errm)
+	}
+
+	return &h, nil
+}
+
+// InitStatus reads sys/init and reports if the node is initialized
+func (c *Client) InitStatus(ctx context.Context) (bool, error) {
+	var r struct {
+		Initialized bool `json:"initialized"`
+	}
+	if err := c.do(ctx, "GET", "sys/init", nil, &r); err != nil {
+		return false, err
+	}
+	return r.Initialized, nil
+}
+
+// Init initializes a vault cluster through sys/init.
+// The request is never retried, a retry after a lost response would only ever see
+// an initialized cluster and the unseal keys would be gone.
+func (c *Client) Init(ctx context.Context, in *InitRequest) (*InitResponse, error) {
+	var r InitResponse
+	if err := c.do(ctx, "PUT", "sys/init", in, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// SealStatus reads sys/seal-status
+func (c *Client) SealStatus(ctx context.Context) (*SealStatusResponse, error) {
+	var r SealStatusResponse
+	if err := c.do(ctx, "GET", "sys/seal-status", nil, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Unseal submits a single unseal key share to sys/unseal.
+// The share is never copied into a string and the request body is zeroed once sent.
+func (c *Client) Unseal(ctx context.Context, key []byte) (*SealStatusResponse, error) {
+	body, err := unsealBody(key)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Zero(body)
+
+	var r SealStatusResponse
+	if err := c.doBody(ctx, "PUT", "sys/unseal", body, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// unsealBody encodes {"key": "<share>"} by hand, the hex and base64 encoded shares vault hands out need no escaping
+func unsealBody(key []byte) ([]byte, error) {
+
+	for _, b := range key {
+		switch {
+		case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		case b == '+', b == '/', b == '=', b == '-', b == '_':
+		default:
+			return nil, errors.New("vault api: the unseal key share is neither hex nor base64 encoded")
+		}
+	}
+
+	body := make([]byte, 0, len(key)+len(`{"key":""}`))
+	body = append(body, `{"key":"`...)
+	body = append(body, key...)
+	body = append(body, `"}`...)
+
+	return body, nil
+}
+
+// UnsealReset discards the key shares submitted so far for the current unseal attempt
+func (c *Client) UnsealReset(ctx context.Context) (*SealStatusResponse, error) {
+	in := map[string]interface{}{
+		"reset": true,
+	}
+	var r SealStatusResponse
+	if err := c.do(ctx, "PUT", "sys/unseal", in, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Leader reads sys/leader
+func (c *Client) Leader(ctx context.Context) (*LeaderResponse, error) {
+	var r LeaderResponse
+	if err := c.do(ctx, "GET", "sys/leader", nil, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// GenerateRootAttempt reads the progress of the current sys/generate-root attempt
+func (c *Client) GenerateRootAttempt(ctx context.Context) (*GenerateRootStatus, error) {
+	var r GenerateRootStatus
+	if err := c.do(ctx, "GET", "sys/generate-root/attempt", nil, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// GenerateRootInit starts a sys/generate-root attempt, the new token is XORed with the base64 encoded otp.
+// An empty otp lets vault 1.0 and later generate one and return it in the status
+func (c *Client) GenerateRootInit(ctx context.Context, otp string) (*GenerateRootStatus, error) {
+	in := map[string]interface{}{}
+	if otp != "" {
+		in["otp"] = otp
+	}
+	var r GenerateRootStatus
+	if err := c.do(ctx, "PUT", "sys/generate-root/attempt", in, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// GenerateRootUpdate submits a single unseal key share to the sys/generate-root attempt identified by nonce
+func (c *Client) GenerateRootUpdate(ctx context.Context, key, nonce string) (*GenerateRootStatus, error) {
+	in := map[string]interface{}{
+		"key":   key,
+		"nonce": nonce,
+	}
+	var r GenerateRootStatus
+	if err := c.do(ctx, "PUT", "sys/generate-root/update", in, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// GenerateRootCancel cancels the current sys/generate-root attempt
+func (c *Client) GenerateRootCancel(ctx context.Context) error {
+	return c.do(ctx, "DELETE", "sys/generate-root/attempt", nil, nil)
+}
+
+// ListMounts reads sys/mounts and returns the mounted secret backends keyed by their path, eg "secret/"
+func (c *Client) ListMounts(ctx context.Context) (map[string]*MountOutput, error) {
+	var raw map[string]json.RawMessage
+	if err := c.do(ctx, "GET", "sys/mounts", nil, &raw); err != nil {
+		return nil, err
+	}
+	return decodeMountMap(raw)
+}
+
+// Mount mounts a secret backend at path through sys/mounts/<path>
+func (c *Client) Mount(ctx context.Context, path string, in *MountInput) error {
+	return c.do(ctx, "POST", "sys/mounts/"+strings.Trim(path, "/"), in, nil)
+}
+
+// Unmount removes the secret backend mounted at path
+func (c *Client) Unmount(ctx context.Context, path string) error {
+	return c.do(ctx, "DELETE", "sys/mounts/"+strings.Trim(path, "/"), nil, nil)
+}
+
+// TuneMount updates the tunable settings of the secret backend mounted at path
+func (c *Client) TuneMount(ctx context.Context, path string, in *MountTuneInput) error {
+	return c.idempotent().do(ctx, "POST", "sys/mounts/"+strings.Trim(path, "/")+"/tune", in, nil)
+}
+
+// ListAuth reads sys/auth and returns the enabled auth methods keyed by their path, eg "approle/"
+func (c *Client) ListAuth(ctx context.Context) (map[string]*MountOutput, error) {
+	var raw map[string]json.RawMessage
+	if err := c.do(ctx, "GET", "sys/auth", nil, &raw); err != nil {
+		return nil, err
+	}
+	return decodeMountMap(raw)
+}
+
+// EnableAuth enables an auth method at path through sys/auth/<path>
+func (c *Client) EnableAuth(ctx context.Context, path string, in *MountInput) error {
+	return c.do(ctx, "POST", "sys/auth/"+strings.Trim(path, "/"), in, nil)
+}
+
+// DisableAuth disables the auth method enabled at path
+func (c *Client) DisableAuth(ctx context.Context, path string) error {
+	return c.do(ctx, "DELETE", "sys/auth/"+strings.Trim(path, "/"), nil, nil)
+}
+
+// TuneAuth updates the tunable settings of the auth method enabled at path
+func (c *Client) TuneAuth(ctx context.Context, path string, in *MountTuneInput) error {
+	return c.idempotent().do(ctx, "POST", "sys/auth/"+strings.Trim(path, "/")+"/tune", in, nil)
+}
+
+// ListAudit reads sys/audit and returns the enabled audit devices keyed by their path, eg "file/"
+func (c *Client) ListAudit(ctx context.Context) (map[string]*AuditDevice, error) {
+	var raw map[string]json.RawMessage
+	if err := c.do(ctx, "GET", "sys/audit", nil, &raw); err != nil {
+		return nil, err
+	}
+	if d, ok := raw["data"]; ok {
+		var nested map[string]json.RawMessage
+		if err := json.Unmarshal(d, &nested); err == nil && len(nested) != 0 {
+			raw = nested
+		}
+	}
+
+	devices := make(map[string]*AuditDevice)
+	for k, v := range raw {
+		if !strings.HasSuffix(k, "/") {
+			continue
+		}
+		var d AuditDevice
+		if err := json.Unmarshal(v, &d); err != nil {
+			errm := fmt.Sprintf("vault api: unable to decode audit device %v: %v", k, err)
+			return nil, errors.New(errm)
+		}
+		devices[k] = &d
+	}
+	return devices, nil
+}
+
+// EnableAudit enables an audit device at path through sys/audit/<path>
+func (c *Client) EnableAudit(ctx context.Context, path string, in *AuditDevice) error {
+	return c.do(ctx, "PUT", "sys/audit/"+strings.Trim(path, "/"), in, nil)
+}
+
+// ListPolicies reads sys/policy and returns the sorted policy names
+func (c *Client) ListPolicies(ctx context.Context) ([]string, error) {
+	var r struct {
+		Policies []string `json:"policies"`
+		Data     struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, "GET", "sys/policy", nil, &r); err != nil {
+		return nil, err
+	}
+	p := r.Policies
+	if len(p) == 0 {
+		p = r.Data.Keys
+	}
+	sort.Strings(p)
+	return p, nil
+}
+
+// GetPolicy reads the rules of a single policy
+func (c *Client) GetPolicy(ctx context.Context, name string) (string, error) {
+	var r struct {
+		Rules string `json:"rules"`
+	}
+	if err := c.do(ctx, "GET", "sys/policy/"+name, nil, &r); err != nil {
+		return "", err
+	}
+	return r.Rules, nil
+}
+
+// PutPolicy creates or updates a policy
+func (c *Client) PutPolicy(ctx context.Context, name, rules string) error {
+	in := map[string]interface{}{
+		"rules": rules,
+	}
+	return c.idempotent().do(ctx, "PUT", "sys/policy/"+name, in, nil)
+}
+
+// DeletePolicy deletes a policy
+func (c *Client) DeletePolicy(ctx context.Context, name string) error {
+	return c.do(ctx, "DELETE", "sys/policy/"+name, nil, nil)
+}
+
+// decodeMountMap decodes the sys/mounts and sys/auth style responses.
+// Newer vault versions nest the mounts under "data", older ones return them at the top level
+// next to the request metadata, so only keys ending with "/" are considered.
+func decodeMountMap(raw map[string]json.RawMessage) (map[string]*MountOutput, error) {
+
+	if d, ok := raw["data"]; ok {
+		var nested map[string]json.RawMessage
+		if err := json.Unmarshal(d, &nested); err == nil && len(nested) != 0 {
+			raw = nested
+		}
+	}
+
+	mounts := make(map[string]*MountOutput)
+	for k, v := range raw {
+		if !strings.HasSuffix(k, "/") {
+			continue
+		}
+		var m MountOutput
+		if err := json.Unmarshal(v, &m); err != nil {
+			errm := fmt.Sprintf("vault api: unable to decode mount %v: %v", k, err)
+			return nil, errors.New(errm)
+		}
+		mounts[k] = &m
+	}
+
+	return mounts, nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"context"
+	"errors"
+)
+
+// TokenData is the data of a token lookup
+type TokenData struct {
+	Accessor    string            `json:"accessor"`
+	DisplayName string            `json:"display_name"`
+	Policies    []string          `json:"policies"`
+	TTL         int               `json:"ttl"`
+	Period      int               `json:"period"`
+	Orphan      bool              `json:"orphan"`
+	ExpireTime  string            `json:"expire_time"`
+	Meta        map[string]string `json:"meta"`
+}
+
+// TokenCreateRequest is the body sent to auth/token/create and auth/token/create-orphan
+type TokenCreateRequest struct {
+	Policies    []string          `json:"policies,omitempty"`
+	TTL         string            `json:"ttl,omitempty"`
+	Period      string            `json:"period,omitempty"`
+	DisplayName string            `json:"display_name,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+}
+
+// TokenAuth is the auth section of a token create response
+type TokenAuth struct {
+	ClientToken   string            `json:"client_token"`
+	Accessor      string            `json:"accessor"`
+	Policies      []string          `json:"policies"`
+	Metadata      map[string]string `json:"metadata"`
+	LeaseDuration int               `json:"lease_duration"`
+	Renewable     bool              `json:"renewable"`
+}
+
+// CreateToken creates a token through auth/token/create, or auth/token/create-orphan for an orphan token.
+// The request is never retried so that a lost response can't leave an untracked token behind.
+func (c *Client) CreateToken(ctx context.Context, in *TokenCreateRequest, orphan bool) (*TokenAuth, error) {
+	path := "auth/token/create"
+	if orphan {
+		path = "auth/token/create-orphan"
+	}
+	var r struct {
+		Auth *TokenAuth `json:"auth"`
+	}
+	if err := c.do(ctx, "POST", path, in, &r); err != nil {
+		return nil, err
+	}
+	if r.Auth == nil {
+		return nil, errors.New("vault api: token create response without auth section")
+	}
+	return r.Auth, nil
+}
+
+// RevokeOrphan revokes a token through auth/token/revoke-orphan, its child tokens become orphans instead of being revoked
+func (c *Client) RevokeOrphan(ctx context.Context, token string) error {
+	in := map[string]interface{}{
+		"token": token,
+	}
+	return c.do(ctx, "POST", "auth/token/revoke-orphan", in, nil)
+}
+
+// LookupAccessor reads the properties of the token behind an accessor
+func (c *Client) LookupAccessor(ctx context.Context, accessor string) (*TokenData, error) {
+	in := map[string]interface{}{
+		"accessor": accessor,
+	}
+	var r struct {
+		Data TokenData `json:"data"`
+	}
+	if err := c.idempotent().do(ctx, "POST", "auth/token/lookup-accessor", in, &r); err != nil {
+		return nil, err
+	}
+	return &r.Data, nil
+}
+
+// RevokeAccessor revokes the token behind an accessor
+func (c *Client) RevokeAccessor(ctx context.Context, accessor string) error {
+	in := map[string]interface{}{
+		"accessor": accessor,
+	}
+	return c.do(ctx, "POST", "auth/token/revoke-accessor", in, nil)
+}
+
+// LookupSelf reads auth/token/lookup-self for the client token
+func (c *Client) LookupSelf(ctx context.Context) (*TokenData, error) {
+	var r struct {
+		Data TokenData `json:"data"`
+	}
+	if err := c.do(ctx, "GET", "auth/token/lookup-self", nil, &r); err != nil {
+		return nil, err
+	}
+	return &r.Data, nil
+}
+
+// RevokeSelf revokes the client token through auth/token/revoke-self
+func (c *Client) RevokeSelf(ctx context.Context) error {
+	return c.do(ctx, "POST", "auth/token/revoke-self", nil, nil)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
+)
+
+// supported audit device types and the options each one needs
+var auditTypes = map[string][]string{
+	"file":   {"file_path"},
+	"syslog": nil,
+	"socket": {"address"},
+}
+
+// AuditDevice is a definition of a vault audit device
+type AuditDevice struct {
+	Type string `yaml:"type" json:"type"`
+	// Path is where the audit device is enabled, it defaults to its type
+	Path        string            `yaml:"path,omitempty" json:"path,omitempty"`
+	Description string            `yaml:"description,omitempty" json:"description,omitempty"`
+	Options     map[string]string `yaml:"options,omitempty" json:"options,omitempty"`
+	Local       bool              `yaml:"local,omitempty" json:"local,omitempty"`
+}
+
+// mountPath returns the path the audit device is enabled at, eg "file/"
+func (a AuditDevice) mountPath() string {
+	if a.Path == "" {
+		return mountPath(a.Type)
+	}
+	return mountPath(a.Path)
+}
+
+// validateAuditDevices checks the vault_audit_devices section
+func (g *Config) validateAuditDevices() error {
+
+	paths := make(map[string]bool)
+	for i, a := range g.AuditDevices {
+		required, ok := auditTypes[a.Type]
+		if !ok {
+			errm := fmt.Sprintf("vault_audit_devices entry %v has an unsupported type %q", i, a.Type)
+			return errors.New(errm)
+		}
+		for _, o := range required {
+			if a.Options[o] == "" {
+				errm := fmt.Sprintf("vault_audit_devices entry %v of type %v needs the %v option", i, a.Type, o)
+				return errors.New(errm)
+			}
+		}
+		p := a.mountPath()
+		if paths[p] {
+			errm := fmt.Sprintf("audit path %v is declared more than once in vault_audit_devices", p)
+			return errors.New(errm)
+		}
+		paths[p] = true
+	}
+
+	return nil
+}
+
+// diffAudit compares the declared audit devices with the live ones.
+// Audit devices can't be tuned, a device whose options differ is only reported since
+// re-enabling it would leave a window without auditing.
+func diffAudit(vgc Config, live map[string]*api.AuditDevice) []change {
+
+	var changes []change
+	declared := make(map[string]bool)
+	for _, a := range vgc.AuditDevices {
+		a := a
+		path := a.mountPath()
+		declared[path] = true
+
+		d, ok := live[path]
+		if !ok {
+			changes = append(changes, change{
+				kind:   "audit",
+				action: actionAdd,
+				name:   path,
+				detail: "type " + a.Type,
+				apply: func(ctx context.Context, c *api.Client) error {
+					in := &api.AuditDevice{
+						Type:        a.Type,
+						Description: a.Description,
+						Options:     a.Options,
+						Local:       a.Local,
+					}
+					return c.EnableAudit(ctx, path, in)
+				},
+			})
+			continue
+		}
+
+		var details []string
+		if d.Type != a.Type {
+			details = append(details, fmt.Sprintf("type %v -> %v", d.Type, a.Type))
+		}
+		var keys []string
+		for k := range a.Options {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if lv, ok := d.Options[k]; ok && lv != a.Options[k] {
+				details = append(details, fmt.Sprintf("option %v %q -> %q", k, lv, a.Options[k]))
+			}
+		}
+		if len(details) != 0 {
+			changes = append(changes, change{
+				kind:   "audit",
+				action: actionChange,
+				name:   path,
+				detail: strings.Join(details, ", "),
+			})
+		}
+	}
+
+	var unmanaged []string
+	for path := range live {
+		if !declared[path] {
+			unmanaged = append(unmanaged, path)
+		}
+	}
+	sort.Strings(unmanaged)
+	for _, path := range unmanaged {
+		changes = append(changes, change{
+			kind:   "audit",
+			action: actionUnmanaged,
+			name:   path,
+			detail: "type " + live[path].Type + " is not declared in vault_audit_devices",
+		})
+	}
+
+	return changes
+}
+
+// auditChanges reads the live audit devices of a cluster and compares them with the declared ones
+func auditChanges(ctx context.Context, vgc Config, c *api.Client, cluster string) ([]change, error) {
+
+	live, err := c.ListAudit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffAudit(vgc, live), nil
+}
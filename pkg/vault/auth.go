@@ -0,0 +1,322 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
+)
+
+// the token auth method can't be disabled, it is never reported nor pruned
+const authToken = "token/"
+
+// defaultRolePath is where most auth methods keep their roles, eg auth/approle/role/<name>
+const defaultRolePath = "role"
+
+// AuthBackend is a definition of a vault auth method
+type AuthBackend struct {
+	Type string `yaml:"type" json:"type"`
+	// Path is where the auth method is enabled, it defaults to its type
+	Path        string     `yaml:"path,omitempty" json:"path,omitempty"`
+	Description string     `yaml:"description,omitempty" json:"description,omitempty"`
+	Tune        TuneConfig `yaml:"tune,omitempty" json:"tune,omitempty"`
+	// Config is written to auth/<path>/config
+	Config map[string]interface{} `yaml:"config,omitempty" json:"config,omitempty"`
+	// Roles are written to auth/<path>/<role_path>/<name>, role_path defaults to role, userpass uses users
+	RolePath string                            `yaml:"role_path,omitempty" json:"role_path,omitempty"`
+	Roles    map[string]map[string]interface{} `yaml:"roles,omitempty" json:"roles,omitempty"`
+}
+
+// mountPath returns the path the auth method is enabled at, eg "approle/"
+func (a AuthBackend) mountPath() string {
+	if a.Path == "" {
+		return mountPath(a.Type)
+	}
+	return mountPath(a.Path)
+}
+
+func (a AuthBackend) rolePath() string {
+	if a.RolePath == "" {
+		return defaultRolePath
+	}
+	return strings.Trim(a.RolePath, "/")
+}
+
+// validateAuthBackends checks the vault_auth_backends section
+func (g *Config) validateAuthBackends() error {
+
+	paths := make(map[string]bool)
+	for i, a := range g.AuthBackends {
+		p := a.mountPath()
+		if a.Type == "" || p == "/" {
+			errm := fmt.Sprintf("vault_auth_backends entry %v needs a type", i)
+			return errors.New(errm)
+		}
+		if p == authToken {
+			return errors.New("the token auth method can't be declared in vault_auth_backends")
+		}
+		if paths[p] {
+			errm := fmt.Sprintf("auth path %v is declared more than once in vault_auth_backends", p)
+			return errors.New(errm)
+		}
+		paths[p] = true
+		if err := a.Tune.validate(); err != nil {
+			errm := fmt.Sprintf("auth method %v: %v", p, err)
+			return errors.New(errm)
+		}
+		for name := range a.Roles {
+			if name == "" || strings.Contains(name, "/") {
+				errm := fmt.Sprintf("auth method %v has an invalid role name %q", p, name)
+				return errors.New(errm)
+			}
+		}
+	}
+
+	return nil
+}
+
+// authState is the live state of the auth methods of a cluster
+type authState struct {
+	methods map[string]*api.MountOutput
+	// config and roles are only read for the declared auth methods that are enabled
+	config map[string]map[string]interface{}
+	roles  map[string]map[string]map[string]interface{}
+}
+
+// readAuthState reads the enabled auth methods and the config and roles of the declared ones
+func readAuthState(ctx context.Context, vgc Config, c *api.Client) (*authState, error) {
+
+	methods, err := c.ListAuth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st := &authState{
+		methods: methods,
+		config:  make(map[string]map[string]interface{}),
+		roles:   make(map[string]map[string]map[string]interface{}),
+	}
+
+	for _, a := range vgc.AuthBackends {
+		path := a.mountPath()
+		if m, ok := methods[path]; !ok || m.Type != a.Type {
+			continue
+		}
+		if len(a.Config) != 0 {
+			data, err := c.Read(ctx, "auth/"+path+"config")
+			if err != nil {
+				errm := fmt.Sprintf("unable to read the config of auth method %v: %v", path, err)
+				return nil, errors.New(errm)
+			}
+			st.config[path] = data
+		}
+
+		// step: not every auth method has roles, only the ones with declared roles are listed
+		if len(a.Roles) == 0 {
+			continue
+		}
+		names, err := c.List(ctx, "auth/"+path+a.rolePath())
+		if err != nil {
+			errm := fmt.Sprintf("unable to list the roles of auth method %v: %v", path, err)
+			return nil, errors.New(errm)
+		}
+		roles := make(map[string]map[string]interface{})
+		for _, name := range names {
+			roles[name] = nil
+			if _, ok := a.Roles[name]; !ok {
+				continue
+			}
+			data, err := c.Read(ctx, "auth/"+path+a.rolePath()+"/"+name)
+			if err != nil {
+				errm := fmt.Sprintf("unable to read role %v of auth method %v: %v", name, path, err)
+				return nil, errors.New(errm)
+			}
+			roles[name] = data
+		}
+		st.roles[path] = roles
+	}
+
+	return st, nil
+}
+
+// diffAuth compares the declared auth methods with the live ones, with the same semantics as diffMounts
+func diffAuth(vgc Config, st *authState) []change {
+
+	var changes []change
+	declared := make(map[string]bool)
+	for _, a := range vgc.AuthBackends {
+		a := a
+		path := a.mountPath()
+		declared[path] = true
+
+		m, ok := st.methods[path]
+		switch {
+		case !ok:
+			changes = append(changes, change{
+				kind:   "auth",
+				action: actionAdd,
+				name:   path,
+				detail: "type " + a.Type,
+				apply: func(ctx context.Context, c *api.Client) error {
+					if err := c.EnableAuth(ctx, path, &api.MountInput{Type: a.Type, Description: a.Description}); err != nil {
+						return err
+					}
+					if in, _ := a.Tune.diff(api.MountConfig{}); in != nil {
+						return c.TuneAuth(ctx, path, in)
+					}
+					return nil
+				},
+			})
+		case m.Type != a.Type:
+			changes = append(changes, change{
+				kind:   "auth",
+				action: actionChange,
+				name:   path,
+				detail: fmt.Sprintf("type %v is enabled where %v is declared, disabling it would revoke its tokens", m.Type, a.Type),
+			})
+			continue
+		default:
+			in, details := a.Tune.diff(m.Config)
+			if m.Description != a.Description {
+				desc := a.Description
+				if in == nil {
+					in = &api.MountTuneInput{}
+				}
+				in.Description = &desc
+				details = append(details, fmt.Sprintf("description %q -> %q", m.Description, a.Description))
+			}
+			if in != nil {
+				changes = append(changes, change{
+					kind:   "auth",
+					action: actionChange,
+					name:   path,
+					detail: strings.Join(details, ", "),
+					apply: func(ctx context.Context, c *api.Client) error {
+						return c.TuneAuth(ctx, path, in)
+					},
+				})
+			}
+		}
+
+		changes = append(changes, diffAuthData(vgc, a, st)...)
+	}
+
+	var unmanaged []string
+	for path := range st.methods {
+		if !declared[path] && path != authToken {
+			unmanaged = append(unmanaged, path)
+		}
+	}
+	sort.Strings(unmanaged)
+	for _, path := range unmanaged {
+		path := path
+		ch := change{
+			kind:   "auth",
+			action: actionUnmanaged,
+			name:   path,
+			detail: "type " + st.methods[path].Type + " is not declared in vault_auth_backends",
+		}
+		if vgc.AuthPrune {
+			ch.action = actionRemove
+			ch.apply = func(ctx context.Context, c *api.Client) error {
+				return c.DisableAuth(ctx, path)
+			}
+		}
+		changes = append(changes, ch)
+	}
+
+	return changes
+}
+
+// diffAuthData compares the declared config and roles of an auth method with the live ones
+func diffAuthData(vgc Config, a AuthBackend, st *authState) []change {
+
+	var changes []change
+	path := a.mountPath()
+	enabled := false
+	if m, ok := st.methods[path]; ok && m.Type == a.Type {
+		enabled = true
+	}
+
+	if len(a.Config) != 0 {
+		cpath := "auth/" + path + "config"
+		write := func(ctx context.Context, c *api.Client) error {
+			_, err := c.Write(ctx, cpath, a.Config)
+			return err
+		}
+		live := st.config[path]
+		if !enabled || live == nil {
+			changes = append(changes, change{kind: "auth-config", action: actionAdd, name: cpath, apply: write})
+		} else if keys := diffData(a.Config, live); len(keys) != 0 {
+			changes = append(changes, change{kind: "auth-config", action: actionChange, name: cpath, detail: "keys " + strings.Join(keys, ","), apply: write})
+		}
+	}
+
+	var names []string
+	for name := range a.Roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	liveRoles := st.roles[path]
+	for _, name := range names {
+		data := a.Roles[name]
+		rpath := "auth/" + path + a.rolePath() + "/" + name
+		write := func(ctx context.Context, c *api.Client) error {
+			_, err := c.Write(ctx, rpath, data)
+			return err
+		}
+		live, ok := liveRoles[name]
+		if !enabled || !ok || live == nil {
+			changes = append(changes, change{kind: "auth-role", action: actionAdd, name: rpath, apply: write})
+		} else if keys := diffData(data, live); len(keys) != 0 {
+			changes = append(changes, change{kind: "auth-role", action: actionChange, name: rpath, detail: "keys " + strings.Join(keys, ","), apply: write})
+		}
+	}
+
+	var unmanaged []string
+	for name := range liveRoles {
+		if _, ok := a.Roles[name]; !ok {
+			unmanaged = append(unmanaged, name)
+		}
+	}
+	sort.Strings(unmanaged)
+	for _, name := range unmanaged {
+		rpath := "auth/" + path + a.rolePath() + "/" + name
+		ch := change{kind: "auth-role", action: actionUnmanaged, name: rpath, detail: "not declared in vault_auth_backends"}
+		if vgc.AuthPrune {
+			ch.action = actionRemove
+			ch.apply = func(ctx context.Context, c *api.Client) error {
+				return c.Delete(ctx, rpath)
+			}
+		}
+		changes = append(changes, ch)
+	}
+
+	return changes
+}
+
+// authChanges reads the live auth methods of a cluster and compares them with the declared ones
+func authChanges(ctx context.Context, vgc Config, c *api.Client, cluster string) ([]change, error) {
+
+	st, err := readAuthState(ctx, vgc, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffAuth(vgc, st), nil
+}
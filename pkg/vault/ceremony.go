@@ -0,0 +1,211 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Ceremony is the config of the key ceremony endpoints where custodians submit unseal key shares
+type Ceremony struct {
+	Enabled    bool                `yaml:"enabled" json:"enabled"`
+	ShareTTL   string              `yaml:"share_ttl,omitempty" json:"share_ttl,omitempty"`
+	Custodians []CeremonyCustodian `yaml:"custodians" json:"custodians"`
+}
+
+// CeremonyCustodian is a custodian allowed to submit key shares, authenticated by the bearer token in TokenEnv
+type CeremonyCustodian struct {
+	Name     string `yaml:"name" json:"name"`
+	TokenEnv string `yaml:"token_env" json:"token_env"`
+}
+
+// validateCeremony checks the key ceremony config
+func (g *Config) validateCeremony() error {
+
+	if !g.Ceremony.Enabled {
+		return nil
+	}
+
+	if g.TLSCert == "" || g.TLSKey == "" {
+		return errors.New("ceremony: key shares are only accepted over TLS, listen_tls_cert and listen_tls_key are required")
+	}
+	if _, err := g.CeremonyShareTTL(); err != nil {
+		return err
+	}
+	if _, err := g.CeremonyTokens(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CeremonyShareTTL returns how long submitted key shares are kept, zero meaning the server default
+func (g *Config) CeremonyShareTTL() (time.Duration, error) {
+
+	if g.Ceremony.ShareTTL == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(g.Ceremony.ShareTTL)
+	if err != nil || d <= 0 {
+		errm := fmt.Sprintf("ceremony: invalid share_ttl %v", g.Ceremony.ShareTTL)
+		return 0, errors.New(errm)
+	}
+
+	return d, nil
+}
+
+// CeremonyTokens reads the bearer token of every ceremony custodian from its env var
+func (g *Config) CeremonyTokens() (map[string]string, error) {
+
+	if len(g.Ceremony.Custodians) == 0 {
+		return nil, errors.New("ceremony: at least one custodian is required")
+	}
+
+	tokens := make(map[string]string)
+	seen := make(map[string]string)
+	for i, c := range g.Ceremony.Custodians {
+		if c.Name == "" || c.TokenEnv == "" {
+			errm := fmt.Sprintf("ceremony: custodian %v needs a name and a token_env", i)
+			return nil, errors.New(errm)
+		}
+		if _, ok := tokens[c.Name]; ok {
+			errm := fmt.Sprintf("ceremony: custodian %v is declared more than once", c.Name)
+			return nil, errors.New(errm)
+		}
+		tok := os.Getenv(c.TokenEnv)
+		if tok == "" {
+			errm := fmt.Sprintf("ceremony: the token env var %v of custodian %v is empty", c.TokenEnv, c.Name)
+			return nil, errors.New(errm)
+		}
+		if other, ok := seen[tok]; ok {
+			errm := fmt.Sprintf("ceremony: custodians %v and %v share a token", other, c.Name)
+			return nil, errors.New(errm)
+		}
+		seen[tok] = c.Name
+		tokens[c.Name] = tok
+	}
+
+	return tokens, nil
+}
+
+// KeyCeremony submits the key shares collected by the key ceremony endpoints to the discovered vault nodes
+type KeyCeremony struct {
+	vgc Config
+	id  WorkerID
+	mu  sync.Mutex
+	dv  map[string][]string
+	// rediscover finds the current vault nodes, the ones known may be gone by the time the threshold is reached
+	rediscover func() map[string][]string
+}
+
+// NewKeyCeremony creates a KeyCeremony, it knows no nodes until SetNodes is called or the threshold of a cluster is reached
+func NewKeyCeremony(vgc Config, rediscover func() map[string][]string, id WorkerID) *KeyCeremony {
+	return &KeyCeremony{
+		vgc:        vgc,
+		id:         id,
+		dv:         make(map[string][]string),
+		rediscover: rediscover,
+	}
+}
+
+// SetNodes replaces the discovered vault nodes with a copy of dv, the caller may keep changing its map
+func (k *KeyCeremony) SetNodes(dv map[string][]string) {
+	cp := make(map[string][]string, len(dv))
+	for cl, nodes := range dv {
+		cp[cl] = append([]string(nil), nodes...)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.dv = cp
+}
+
+func (k *KeyCeremony) nodes(cluster string) ([]string, error) {
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	nodes := k.dv[cluster]
+	if len(nodes) == 0 {
+		errm := fmt.Sprintf("no vault nodes discovered for cluster %v", cluster)
+		return nil, errors.New(errm)
+	}
+
+	return nodes, nil
+}
+
+// Threshold returns the number of key shares needed to unseal a cluster, as reported by the first node that answers
+func (k *KeyCeremony) Threshold(ctx context.Context, cluster string) (int, error) {
+
+	nodes, err := k.nodes(cluster)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, n := range nodes {
+		c, err := k.vgc.newClient(cluster, n)
+		if err != nil {
+			continue
+		}
+		ss, err := c.SealStatus(ctx)
+		if err != nil {
+			if dbgVaultPkg {
+				log.Printf("%v%v: unable to read the seal status of node %v: %v", k.id.Name, k.id.ID, n, err)
+			}
+			continue
+		}
+		return ss.T, nil
+	}
+
+	errm := fmt.Sprintf("none of the %v nodes of cluster %v reported its seal status", len(nodes), cluster)
+	return 0, errors.New(errm)
+}
+
+// Unseal submits the key shares to every sealed node of a cluster
+func (k *KeyCeremony) Unseal(ctx context.Context, cluster string, keys [][]byte) map[string]error {
+
+	// step: the tasks or pods may have been replaced since the last discovery, look the nodes up again
+	if k.rediscover != nil {
+		if dv := k.rediscover(); len(dv[cluster]) != 0 {
+			k.SetNodes(dv)
+		} else {
+			log.Printf("%v%v: rediscovery found no nodes for cluster %v, using the ones known", k.id.Name, k.id.ID, cluster)
+		}
+	}
+
+	nodes, err := k.nodes(cluster)
+	if err != nil {
+		return map[string]error{cluster: err}
+	}
+
+	results := make(map[string]error)
+	for _, n := range nodes {
+		switch e := unsealNodeOnce(ctx, k.vgc, cluster, n, keys, &unsealNode{}, k.id).(type) {
+		case *UnsealOK:
+			results[n] = nil
+		case *UnsealErr:
+			log.Printf("%v%v: %v", k.id.Name, k.id.ID, e)
+			results[n] = e.Err
+		default:
+			results[n] = ctx.Err()
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
+)
+
+// rotationRetry is how long a failed transit key rotation waits before it is retried
+const rotationRetry = 10 * time.Minute
+
+// errNotReady is returned while a cluster has no unsealed active node to configure
+var errNotReady = errors.New("no unsealed active node")
+
+// phase is a single configuration step run with a root token against the active node of an unsealed cluster.
+// Phases that reconcile declared objects provide changes, which plan uses as well, the others provide run.
+// A phase providing both is planned with changes and run with run.
+type phase struct {
+	name    string
+	enabled func(g GuardConfig) bool
+	changes func(ctx context.Context, vgc Config, c *api.Client, cluster string) ([]change, error)
+	run     func(ctx context.Context, vgc Config, c *api.Client, cluster string, id WorkerID) error
+}
+
+// phases run in order, every one of them needs a root token.
+// Audit comes first so that everything done afterwards is audited.
+var phases = []phase{
+	{name: "audit", enabled: func(g GuardConfig) bool { return g.Audit }, changes: auditChanges},
+	{name: "mount", enabled: func(g GuardConfig) bool { return g.Mount }, changes: mountChanges},
+	{name: "pki", enabled: func(g GuardConfig) bool { return g.PKI }, changes: pkiChanges},
+	{name: "transit", enabled: func(g GuardConfig) bool { return g.Transit }, changes: transitChanges},
+	{name: "policies", enabled: func(g GuardConfig) bool { return g.Policies }, changes: policyChanges},
+	{name: "auth", enabled: func(g GuardConfig) bool { return g.Auth }, changes: authChanges},
+	{name: "resources", enabled: func(g GuardConfig) bool { return g.Resources }, changes: resourceChanges, run: runResourcePhase},
+	{name: "seed", enabled: func(g GuardConfig) bool { return g.Seed }, changes: seedChanges},
+	{name: "gentoken", enabled: func(g GuardConfig) bool { return g.Gentoken }, run: runTokenPhase},
+}
+
+// runPhase runs a phase, applying the changes of the reconciling ones
+func runPhase(ctx context.Context, vgc Config, c *api.Client, cluster string, p phase, id WorkerID) error {
+
+	if p.run != nil {
+		return p.run(ctx, vgc, c, cluster, id)
+	}
+
+	changes, err := p.changes(ctx, vgc, c, cluster)
+	if err != nil {
+		return err
+	}
+	if failed := applyChanges(ctx, c, cluster, changes, id); len(failed) != 0 {
+		errm := fmt.Sprintf("%v of %v changes failed", len(failed), len(changes))
+		return errors.New(errm)
+	}
+
+	return nil
+}
+
+// ConfigureEnabled reports if any of the phases that need a root token is enabled
+func (g *Config) ConfigureEnabled() bool {
+	for _, p := range phases {
+		if p.enabled(g.GuardConfig) {
+			return true
+		}
+	}
+	return false
+}
+
+// phasesNamed returns the phases with the given names, in phase order
+func phasesNamed(names ...string) []phase {
+	var ps []phase
+	for _, p := range phases {
+		for _, n := range names {
+			if p.name == n {
+				ps = append(ps, p)
+			}
+		}
+	}
+	return ps
+}
+
+// RunConfigure runs the enabled phases against every discovered cluster once it is unsealed.
+// The root token is acquired for the run and revoked as soon as the phases are done,
+// the root token of a freshly initialized cluster is revoked even when no phase is enabled.
+// Afterwards the transit phase runs again whenever a transit key of a cluster is due for rotation
+// and the gentoken phase runs again every token_check_interval to recreate expired or revoked tokens.
+func RunConfigure(ctx context.Context, vgc Config, wg *sync.WaitGroup, retErrCh chan error, dvCh chan map[string][]string, initCh chan InitResult, st *Status, id WorkerID) error {
+
+	defer wg.Done()
+	defer log.Printf("%v%v: worker shutdown complete", id.Name, id.ID)
+
+	var dv map[string][]string
+	select {
+	case <-ctx.Done():
+		log.Printf("%v%v: caller has asked us to stop processing work; shutting down.", id.Name, id.ID)
+		return nil
+	case dv = <-dvCh:
+	}
+	log.Printf("%v%v: received discovered vault endpoints: %v", id.Name, id.ID, dv)
+
+	interval, err := vgc.unsealInterval()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// the output of the clusters initialized by this process, the root token in it is used once and dropped
+	inits := make(map[string]*InitResult)
+	// without phases the worker only revokes the root tokens of the clusters it initialized
+	pending := make(map[string]bool)
+	if vgc.ConfigureEnabled() {
+		for cl := range dv {
+			pending[cl] = true
+		}
+	}
+	// when the transit keys of a cluster are next due for rotation
+	rotations := make(map[string]time.Time)
+	// when the tokens of a cluster are next checked
+	tokenChecks := make(map[string]time.Time)
+	tokenEvery, err := vgc.tokenCheckInterval()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("%v%v: caller has asked us to stop processing work; shutting down.", id.Name, id.ID)
+			return nil
+		case res := <-initCh:
+			r := res
+			inits[r.Cluster] = &r
+			pending[r.Cluster] = true
+		case <-ticker.C:
+		}
+
+		var clusters []string
+		for cl := range pending {
+			clusters = append(clusters, cl)
+		}
+		sort.Strings(clusters)
+
+		for _, cl := range clusters {
+			err := configureCluster(ctx, vgc, cl, dv[cl], inits[cl], phases, st, id)
+			if err == errNotReady {
+				if dbgVaultPkg {
+					log.Printf("%v%v: cluster %v has no unsealed active node yet", id.Name, id.ID, cl)
+				}
+				continue
+			}
+			// step: the init root token is gone whatever the outcome, later runs generate their own
+			delete(inits, cl)
+			delete(pending, cl)
+			if next, ok := st.nextRotation(cl); ok {
+				rotations[cl] = next
+			}
+			if vgc.Gentoken {
+				tokenChecks[cl] = time.Now().Add(tokenEvery)
+			}
+			if err != nil {
+				sendErr(ctx, retErrCh, err)
+				continue
+			}
+			log.Printf("%v%v: cluster %v configured", id.Name, id.ID, cl)
+		}
+
+		now := time.Now()
+		for cl, next := range rotations {
+			if pending[cl] || now.Before(next) {
+				continue
+			}
+			err := configureCluster(ctx, vgc, cl, dv[cl], nil, phasesNamed("transit"), st, id)
+			if err == errNotReady {
+				continue
+			}
+			delete(rotations, cl)
+			if next, ok := st.nextRotation(cl); ok && next.After(now) {
+				rotations[cl] = next
+			}
+			if err != nil {
+				rotations[cl] = now.Add(rotationRetry)
+				sendErr(ctx, retErrCh, err)
+				continue
+			}
+			log.Printf("%v%v: rotated the transit keys of cluster %v", id.Name, id.ID, cl)
+		}
+
+		for cl, next := range tokenChecks {
+			if pending[cl] || now.Before(next) {
+				continue
+			}
+			err := configureCluster(ctx, vgc, cl, dv[cl], nil, phasesNamed("gentoken"), st, id)
+			if err == errNotReady {
+				continue
+			}
+			tokenChecks[cl] = time.Now().Add(tokenEvery)
+			if err != nil {
+				sendErr(ctx, retErrCh, err)
+				continue
+			}
+			if dbgVaultPkg {
+				log.Printf("%v%v: checked the tokens of cluster %v", id.Name, id.ID, cl)
+			}
+		}
+	}
+}
+
+// configureCluster runs the enabled phases of ps against the active node of a cluster with a root token held only for the run
+func configureCluster(ctx context.Context, vgc Config, cluster string, nodes []string, mem *InitResult, ps []phase, st *Status, id WorkerID) error {
+
+	c, err := activeNode(ctx, vgc, cluster, nodes)
+	if err != nil {
+		return err
+	}
+
+	rt, err := acquireRoot(ctx, vgc, cluster, c, mem, id)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	rc := c.WithToken(rt.token)
+	for _, p := range ps {
+		if !p.enabled(vgc.GuardConfig) {
+			continue
+		}
+		if err := runPhase(ctx, vgc, rc, cluster, p, id); err != nil {
+			log.Printf("%v%v: %v phase failed for cluster %v: %v", id.Name, id.ID, p.name, cluster, err)
+			failed = append(failed, p.name)
+		}
+	}
+	if vgc.Transit {
+		keys, err := transitStatus(ctx, vgc, rc)
+		if err != nil {
+			log.Printf("%v%v: unable to read the transit keys of cluster %v: %v", id.Name, id.ID, cluster, err)
+		} else {
+			st.setTransit(cluster, keys)
+		}
+	}
+
+	// step: revoke the root token even when a phase failed
+	if err := releaseRoot(ctx, vgc, cluster, c, rt, id); err != nil {
+		return err
+	}
+
+	if len(failed) != 0 {
+		errm := fmt.Sprintf("%v%v: phases %v failed for cluster %v", id.Name, id.ID, strings.Join(failed, ","), cluster)
+		return errors.New(errm)
+	}
+
+	return nil
+}
+
+// activeNode returns a client for the unsealed active node of a cluster
+func activeNode(ctx context.Context, vgc Config, cluster string, nodes []string) (*api.Client, error) {
+
+	for _, n := range nodes {
+		c, err := vgc.newClient(cluster, n)
+		if err != nil {
+			continue
+		}
+		h, err := c.Health(ctx)
+		if err != nil {
+			continue
+		}
+		if h.Initialized && !h.Sealed && !h.Standby {
+			return c, nil
+		}
+	}
+
+	return nil, errNotReady
+}
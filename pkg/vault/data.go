@@ -0,0 +1,179 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// normalizeData converts the map[interface{}]interface{} values the yaml decoder produces into
+// map[string]interface{} so that declared data can be JSON encoded and compared with what vault returns
+func normalizeData(v interface{}) interface{} {
+
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, val := range t {
+			m[fmt.Sprintf("%v", k)] = normalizeData(val)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{})
+		for k, val := range t {
+			m[k] = normalizeData(val)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i := range t {
+			l[i] = normalizeData(t[i])
+		}
+		return l
+	}
+
+	return v
+}
+
+// normalizeMap normalizes declared data, see normalizeData
+func normalizeMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	return normalizeData(m).(map[string]interface{})
+}
+
+// diffData returns the sorted keys whose declared value differs from the live one.
+// Keys that are not returned by vault, eg passwords and secret ids, are write only and can't be compared.
+func diffData(declared map[string]interface{}, live map[string]interface{}) []string {
+
+	var keys []string
+	for k, dv := range declared {
+		lv, ok := live[k]
+		if !ok {
+			continue
+		}
+		if !valuesEqual(dv, lv) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// valuesEqual compares a declared value with the value vault returns for it.
+// Vault returns durations as seconds and comma separated lists as arrays, both forms are accepted.
+func valuesEqual(declared interface{}, live interface{}) bool {
+
+	d := jsonValue(declared)
+	l := jsonValue(live)
+	if reflect.DeepEqual(d, l) {
+		return true
+	}
+
+	switch dv := d.(type) {
+	case string:
+		switch lv := l.(type) {
+		case float64:
+			if f, err := strconv.ParseFloat(dv, 64); err == nil {
+				return f == lv
+			}
+			if dur, err := time.ParseDuration(dv); err == nil {
+				return dur.Seconds() == lv
+			}
+		case bool:
+			if b, err := strconv.ParseBool(dv); err == nil {
+				return b == lv
+			}
+		case []interface{}:
+			var parts []interface{}
+			if strings.TrimSpace(dv) != "" {
+				for _, p := range strings.Split(dv, ",") {
+					parts = append(parts, strings.TrimSpace(p))
+				}
+			}
+			return valuesEqual(parts, lv)
+		}
+	case []interface{}:
+		lv, ok := l.([]interface{})
+		if !ok {
+			if ls, ok := l.(string); ok {
+				return valuesEqual(ls, dv)
+			}
+			return false
+		}
+		if len(dv) != len(lv) {
+			return false
+		}
+		for i := range dv {
+			if !valuesEqual(dv[i], lv[i]) {
+				return false
+			}
+		}
+		return true
+	case float64:
+		if ls, ok := l.(string); ok {
+			return valuesEqual(ls, dv)
+		}
+	case bool:
+		if ls, ok := l.(string); ok {
+			return valuesEqual(ls, dv)
+		}
+	case nil:
+		// an unset declared value matches vault's empty defaults
+		switch lv := l.(type) {
+		case string:
+			return lv == ""
+		case []interface{}:
+			return len(lv) == 0
+		}
+	}
+
+	return false
+}
+
+// jsonValue returns a value in the form it has after a JSON round trip, eg every number is a float64
+func jsonValue(v interface{}) interface{} {
+
+	b, err := json.Marshal(normalizeData(v))
+	if err != nil {
+		return v
+	}
+	var out interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return v
+	}
+
+	return out
+}
+
+// durationSeconds converts a declared duration into the seconds vault reports, an empty duration is 0
+func durationSeconds(d string) (int, error) {
+
+	if d == "" {
+		return 0, nil
+	}
+	dur, err := time.ParseDuration(d)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(dur.Seconds()), nil
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
+)
+
+// actions of a change
+const (
+	actionAdd    = "add"
+	actionChange = "change"
+	actionRemove = "remove"
+	// actionUnmanaged is something that exists in vault but not in the config, it is only reported
+	actionUnmanaged = "unmanaged"
+)
+
+// change is a single difference between the declared config and a live cluster
+type change struct {
+	kind   string
+	action string
+	name   string
+	detail string
+	// apply brings the cluster in line with the config, nil when the change can only be reported
+	apply func(ctx context.Context, c *api.Client) error
+}
+
+// String formats a change for logs and plans
+func (ch change) String() string {
+	s := fmt.Sprintf("%v %v %v", ch.action, ch.kind, ch.name)
+	if ch.detail != "" {
+		s += ": " + ch.detail
+	}
+	if ch.apply == nil && ch.action != actionUnmanaged {
+		s += " (manual action required)"
+	}
+	return s
+}
+
+// sortChanges orders changes by kind, then name, then action
+func sortChanges(changes []change) {
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].kind != changes[j].kind {
+			return changes[i].kind < changes[j].kind
+		}
+		if changes[i].name != changes[j].name {
+			return changes[i].name < changes[j].name
+		}
+		return changes[i].action < changes[j].action
+	})
+}
+
+// applyChanges applies every change that can be applied and reports the others.
+// It returns the changes that failed to apply.
+func applyChanges(ctx context.Context, c *api.Client, cluster string, changes []change, id WorkerID) []change {
+
+	var failed []change
+	for _, ch := range changes {
+		if ch.apply == nil {
+			log.Printf("%v%v: cluster %v: %v", id.Name, id.ID, cluster, ch)
+			continue
+		}
+		if err := ch.apply(ctx, c); err != nil {
+			log.Printf("%v%v: cluster %v: unable to %v: %v", id.Name, id.ID, cluster, ch, err)
+			failed = append(failed, ch)
+			continue
+		}
+		log.Printf("%v%v: cluster %v: %v", id.Name, id.ID, cluster, ch)
+	}
+
+	return failed
+}
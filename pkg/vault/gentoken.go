@@ -0,0 +1,207 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
+)
+
+// defaultTokenCheckInterval is how often the gentoken phase runs again when token_check_interval is not set
+const defaultTokenCheckInterval = time.Hour
+
+// validateTokens checks the vault_tokens section
+func (g *Config) validateTokens() error {
+
+	if !g.Gentoken {
+		return nil
+	}
+	if g.StateDir == "" || g.TokenDir == "" {
+		return errors.New("gentoken needs state_dir to track the token accessors and token_dir to write the tokens to")
+	}
+	if _, err := g.tokenCheckInterval(); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for i, t := range g.Tokens {
+		if t.Name == "" || t.Name == "." || t.Name == ".." || strings.ContainsAny(t.Name, "/\\") || names[t.Name] {
+			errm := fmt.Sprintf("vault_tokens entry %v needs a unique name usable as a file name", i)
+			return errors.New(errm)
+		}
+		names[t.Name] = true
+		if t.TTL != "" {
+			if d, err := time.ParseDuration(t.TTL); err != nil || d <= 0 {
+				errm := fmt.Sprintf("token %v has an invalid ttl %v", t.Name, t.TTL)
+				return errors.New(errm)
+			}
+		}
+		// step: the tokens are created with a root token, without policies they would inherit root
+		if len(t.Policies) == 0 {
+			errm := fmt.Sprintf("token %v needs at least one policy", t.Name)
+			return errors.New(errm)
+		}
+		for _, p := range t.Policies {
+			if p == "" || p == policyRoot {
+				errm := fmt.Sprintf("token %v has an invalid policy %q, root tokens can't be generated", t.Name, p)
+				return errors.New(errm)
+			}
+		}
+		if t.Periodic && t.TTL == "" {
+			errm := fmt.Sprintf("periodic token %v needs a ttl to use as its period", t.Name)
+			return errors.New(errm)
+		}
+	}
+
+	return nil
+}
+
+// tokenCheckInterval returns how often the gentoken phase runs again after a cluster has been configured
+func (g *Config) tokenCheckInterval() (time.Duration, error) {
+	if g.TokenCheckInterval == "" {
+		return defaultTokenCheckInterval, nil
+	}
+	d, err := time.ParseDuration(g.TokenCheckInterval)
+	if err != nil || d <= 0 {
+		errm := fmt.Sprintf("invalid token_check_interval %v", g.TokenCheckInterval)
+		return 0, errors.New(errm)
+	}
+	return d, nil
+}
+
+// request converts the token definition into a token create request
+func (t Token) request() *api.TokenCreateRequest {
+
+	in := &api.TokenCreateRequest{
+		Policies:    t.Policies,
+		DisplayName: t.DisplayName,
+		Meta:        t.Metadata,
+	}
+	if t.Periodic {
+		in.Period = t.TTL
+	} else {
+		in.TTL = t.TTL
+	}
+
+	return in
+}
+
+// tokenPath returns the file a token of a cluster is written to
+func (g *Config) tokenPath(cluster string, name string) string {
+	return filepath.Join(g.TokenDir, cluster, name+".token")
+}
+
+// runTokenPhase creates the declared tokens that don't exist yet and recreates the ones that expired or were revoked
+func runTokenPhase(ctx context.Context, vgc Config, c *api.Client, cluster string, id WorkerID) error {
+
+	st, err := vgc.loadState(cluster)
+	if err != nil {
+		return err
+	}
+	if st.Tokens == nil {
+		st.Tokens = make(map[string]tokenState)
+	}
+
+	var failed []string
+	for _, t := range vgc.Tokens {
+		if ts, ok := st.Tokens[t.Name]; ok {
+			alive, err := tokenAlive(ctx, c, ts.Accessor)
+			if err != nil {
+				log.Printf("%v%v: unable to look up token %v of cluster %v: %v", id.Name, id.ID, t.Name, cluster, err)
+				failed = append(failed, t.Name)
+				continue
+			}
+			if alive {
+				continue
+			}
+			log.Printf("%v%v: token %v of cluster %v has expired or been revoked, recreating it", id.Name, id.ID, t.Name, cluster)
+		}
+
+		if err := createToken(ctx, vgc, c, cluster, t, st, id); err != nil {
+			log.Printf("%v%v: %v", id.Name, id.ID, err)
+			failed = append(failed, t.Name)
+		}
+	}
+
+	if len(failed) != 0 {
+		errm := fmt.Sprintf("tokens %v could not be reconciled", strings.Join(failed, ","))
+		return errors.New(errm)
+	}
+
+	return nil
+}
+
+// createToken creates a token, writes it to its file and records its accessor in the cluster state.
+// The tokens are always orphans, the root token they are created with is revoked at the end of the run.
+func createToken(ctx context.Context, vgc Config, c *api.Client, cluster string, t Token, st *clusterState, id WorkerID) error {
+
+	auth, err := c.CreateToken(ctx, t.request(), true)
+	if err != nil {
+		errm := fmt.Sprintf("unable to create token %v on cluster %v: %v", t.Name, cluster, err)
+		return errors.New(errm)
+	}
+
+	// step: a token nobody can read is useless, revoke it rather than leave it behind
+	path := vgc.tokenPath(cluster, t.Name)
+	if err := writeFileAtomic(path, []byte(auth.ClientToken+"\n"), 0600); err != nil {
+		if rerr := c.RevokeAccessor(ctx, auth.Accessor); rerr != nil {
+			log.Printf("%v%v: unable to revoke the unwritten token %v of cluster %v (accessor %v): %v", id.Name, id.ID, t.Name, cluster, auth.Accessor, rerr)
+		}
+		errm := fmt.Sprintf("unable to write token %v of cluster %v to %v: %v", t.Name, cluster, path, err)
+		return errors.New(errm)
+	}
+
+	st.Tokens[t.Name] = tokenState{
+		Accessor: auth.Accessor,
+		Created:  time.Now().UTC(),
+	}
+	if err := vgc.saveState(cluster, st); err != nil {
+		errm := fmt.Sprintf("token %v of cluster %v was created but its accessor %v could not be saved: %v", t.Name, cluster, auth.Accessor, err)
+		return errors.New(errm)
+	}
+	log.Printf("%v%v: created token %v (accessor %v) on cluster %v and wrote it to %v", id.Name, id.ID, t.Name, auth.Accessor, cluster, path)
+
+	return nil
+}
+
+// tokenAlive reports if the token behind an accessor still exists, vault forgets expired and revoked tokens
+func tokenAlive(ctx context.Context, c *api.Client, accessor string) (bool, error) {
+
+	_, err := c.LookupAccessor(ctx, accessor)
+	if err == nil {
+		return true, nil
+	}
+	aerr, ok := err.(*api.APIError)
+	if !ok {
+		return false, err
+	}
+	if aerr.StatusCode == http.StatusBadRequest || aerr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	for _, e := range aerr.Errors {
+		if strings.Contains(e, "invalid accessor") {
+			return false, nil
+		}
+	}
+
+	return false, err
+}
@@ -0,0 +1,330 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stefancocora/vaultguard/pkg/keystore"
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
+)
+
+// how long the init worker waits for the other cluster nodes to report the cluster as initialized
+const (
+	initConfirmTimeout  = 30 * time.Second
+	initConfirmInterval = 2 * time.Second
+)
+
+// initStoreRetry is how long the init worker waits before it retries storing init material the keystore refused
+const initStoreRetry = 30 * time.Second
+
+// InitResult is the output of initializing a single vault cluster
+type InitResult struct {
+	Cluster   string
+	Node      string
+	Keys      []string
+	KeysB64   []string
+	RootToken string
+}
+
+// RunInit initializes the discovered vault clusters that are not yet initialized
+func RunInit(ctx context.Context, vgc Config, wg *sync.WaitGroup, retErrCh chan error, dvCh chan map[string][]string, initCh chan InitResult, id WorkerID) error {
+
+	defer wg.Done()
+	defer log.Printf("%v%v: worker shutdown complete", id.Name, id.ID)
+
+	var dv map[string][]string
+	select {
+	case <-ctx.Done():
+		log.Printf("%v%v: caller has asked us to stop processing work; shutting down.", id.Name, id.ID)
+		return nil
+	case dv = <-dvCh:
+	}
+	log.Printf("%v%v: received discovered vault endpoints: %v", id.Name, id.ID, dv)
+
+	var clusters []string
+	for cl := range dv {
+		clusters = append(clusters, cl)
+	}
+	sort.Strings(clusters)
+
+	for _, cl := range clusters {
+		res, err := initCluster(ctx, vgc, cl, dv[cl], id)
+		if err != nil {
+			sendErr(ctx, retErrCh, err)
+		}
+		if res == nil {
+			continue
+		}
+
+		// step: hand the PGP encrypted shares to their custodians, keeping only the ones vaultguard may hold
+		if len(vgc.Custodians) != 0 {
+			if err := distributeShares(vgc, res, id); err != nil {
+				sendErr(ctx, retErrCh, err)
+				// step: the shares that were not handed out only survive in the keystore, without one the result is never used
+				if ep, _ := vgc.endpointFor(cl); !ep.KeyStore.Enabled() {
+					log.Printf("%v%v: cluster %v has no keystore for the shares that were not handed out, its root token is not revoked and its init result is not used", id.Name, id.ID, cl)
+					continue
+				}
+			}
+		}
+
+		// step: persist the init material before anything else can go wrong,
+		// the result carries the root token the configure worker revokes so it is only handed on once stored
+		if !persistInit(ctx, vgc, res, retErrCh, id) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("%v%v: caller has asked us to stop processing work; shutting down.", id.Name, id.ID)
+			return nil
+		case initCh <- *res:
+		}
+	}
+
+	return nil
+}
+
+// initCluster initializes a single cluster through exactly one of its nodes.
+// It returns a nil result when the cluster is already initialized or can't be initialized.
+// A non nil result can come together with an error when the other nodes fail to confirm the init.
+func initCluster(ctx context.Context, vgc Config, cluster string, nodes []string, id WorkerID) (*InitResult, error) {
+
+	if len(nodes) == 0 {
+		errm := fmt.Sprintf("%v%v: no vault nodes discovered for cluster %v", id.Name, id.ID, cluster)
+		return nil, errors.New(errm)
+	}
+
+	// step: ask every node if the cluster is initialized, a single yes is enough to leave it alone
+	var candidates []string
+	for _, n := range nodes {
+		c, err := vgc.newClient(cluster, n)
+		if err != nil {
+			log.Printf("%v%v: unable to create a vault client for node %v: %v", id.Name, id.ID, n, err)
+			continue
+		}
+		initialized, err := c.InitStatus(ctx)
+		if err != nil {
+			log.Printf("%v%v: unable to read the init status of node %v: %v", id.Name, id.ID, n, err)
+			continue
+		}
+		if initialized {
+			log.Printf("%v%v: cluster %v is already initialized (reported by %v), skipping", id.Name, id.ID, cluster, n)
+			return nil, nil
+		}
+		candidates = append(candidates, n)
+	}
+	if len(candidates) == 0 {
+		errm := fmt.Sprintf("%v%v: none of the %v nodes of cluster %v reported its init status", id.Name, id.ID, len(nodes), cluster)
+		return nil, errors.New(errm)
+	}
+
+	// step: make sure the init material can be stored before there is any
+	if err := checkKeyStore(vgc, cluster); err != nil {
+		errm := fmt.Sprintf("%v%v: not initializing cluster %v: %v", id.Name, id.ID, cluster, err)
+		return nil, errors.New(errm)
+	}
+
+	// step: initialize the first node that answered, never try another one on failure since
+	// we can't know if the failed request has initialized the cluster
+	node := candidates[0]
+	c, err := vgc.newClient(cluster, node)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%v%v: initializing cluster %v through %v", id.Name, id.ID, cluster, node)
+	in := &api.InitRequest{
+		SecretShares:    vgc.SecretShares,
+		SecretThreshold: vgc.SecretThreshold,
+	}
+	if len(vgc.Custodians) != 0 {
+		keys, err := vgc.pgpKeys()
+		if err != nil {
+			errm := fmt.Sprintf("%v%v: unable to read the custodian PGP keys for cluster %v: %v", id.Name, id.ID, cluster, err)
+			return nil, errors.New(errm)
+		}
+		in.PGPKeys = keys
+	}
+	resp, err := c.Init(ctx, in)
+	if err != nil {
+		if isAlreadyInitialized(err) {
+			log.Printf("%v%v: cluster %v was initialized by someone else in the meantime, skipping", id.Name, id.ID, cluster)
+			return nil, nil
+		}
+		errm := fmt.Sprintf("%v%v: unable to initialize cluster %v through %v: %v", id.Name, id.ID, cluster, node, err)
+		return nil, errors.New(errm)
+	}
+	log.Printf("%v%v: cluster %v initialized through %v", id.Name, id.ID, cluster, node)
+
+	res := &InitResult{
+		Cluster:   cluster,
+		Node:      node,
+		Keys:      resp.Keys,
+		KeysB64:   resp.KeysB64,
+		RootToken: resp.RootToken,
+	}
+
+	// step: confirm the other nodes see the cluster as initialized
+	if err := confirmInit(ctx, vgc, cluster, nodes, node, id); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// confirmInit waits until every node apart from the one that was initialized reports the cluster as initialized
+func confirmInit(ctx context.Context, vgc Config, cluster string, nodes []string, initNode string, id WorkerID) error {
+
+	pending := make(map[string]bool)
+	for _, n := range nodes {
+		if n != initNode {
+			pending[n] = true
+		}
+	}
+
+	deadline := time.After(initConfirmTimeout)
+	ticker := time.NewTicker(initConfirmInterval)
+	defer ticker.Stop()
+
+	for len(pending) != 0 {
+		for n := range pending {
+			c, err := vgc.newClient(cluster, n)
+			if err != nil {
+				continue
+			}
+			initialized, err := c.InitStatus(ctx)
+			if err != nil {
+				if dbgVaultPkg {
+					log.Printf("%v%v: unable to read the init status of node %v: %v", id.Name, id.ID, n, err)
+				}
+				continue
+			}
+			if initialized {
+				log.Printf("%v%v: node %v confirms cluster %v is initialized", id.Name, id.ID, n, cluster)
+				delete(pending, n)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			var pn []string
+			for n := range pending {
+				pn = append(pn, n)
+			}
+			sort.Strings(pn)
+			errm := fmt.Sprintf("%v%v: nodes %v of cluster %v did not confirm the init within %v", id.Name, id.ID, pn, cluster, initConfirmTimeout)
+			return errors.New(errm)
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// isAlreadyInitialized reports if err is vault refusing to initialize an initialized cluster
+func isAlreadyInitialized(err error) bool {
+	aerr, ok := err.(*api.APIError)
+	if !ok || aerr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	for _, e := range aerr.Errors {
+		if strings.Contains(e, "already initialized") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKeyStore makes sure the keystore of a cluster can be opened and reached, a cluster without keystore passes.
+// Only metadata is read, the init material is never decrypted outside of the unseal path.
+func checkKeyStore(vgc Config, cluster string) error {
+
+	ks, err := vgc.keyStoreFor(cluster)
+	if err != nil {
+		errm := fmt.Sprintf("unable to open its keystore: %v", err)
+		return errors.New(errm)
+	}
+	if ks == nil {
+		return nil
+	}
+	if _, err := ks.Exists(cluster); err != nil {
+		errm := fmt.Sprintf("its keystore is not reachable: %v", err)
+		return errors.New(errm)
+	}
+
+	return nil
+}
+
+// persistInit stores the init material of a cluster, retrying until it is stored or the caller asks us to stop.
+// It reports if the material was stored.
+func persistInit(ctx context.Context, vgc Config, res *InitResult, retErrCh chan error, id WorkerID) bool {
+
+	for {
+		err := storeInit(vgc, res, id)
+		if err == nil {
+			return true
+		}
+		sendErr(ctx, retErrCh, err)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("%v%v: stopping before the init material of cluster %v could be stored, its root token was not revoked", id.Name, id.ID, res.Cluster)
+			return false
+		case <-time.After(initStoreRetry):
+		}
+	}
+}
+
+// storeInit writes the init material to the keystore of the cluster endpoint
+func storeInit(vgc Config, res *InitResult, id WorkerID) error {
+
+	ks, err := vgc.keyStoreFor(res.Cluster)
+	if err != nil {
+		errm := fmt.Sprintf("%v%v: unable to open the keystore of cluster %v, retrying in %v: %v", id.Name, id.ID, res.Cluster, initStoreRetry, err)
+		return errors.New(errm)
+	}
+	if ks == nil {
+		log.Printf("%v%v: no keystore configured for cluster %v, the unseal key shares are held by the custodians", id.Name, id.ID, res.Cluster)
+		return nil
+	}
+
+	m := &keystore.Material{
+		Cluster:   res.Cluster,
+		Node:      res.Node,
+		Keys:      res.Keys,
+		KeysB64:   res.KeysB64,
+		RootToken: res.RootToken,
+	}
+	if err := ks.Put(res.Cluster, m); err != nil {
+		errm := fmt.Sprintf("%v%v: unable to store the init material of cluster %v, retrying in %v: %v", id.Name, id.ID, res.Cluster, initStoreRetry, err)
+		return errors.New(errm)
+	}
+	log.Printf("%v%v: init material of cluster %v stored in its keystore", id.Name, id.ID, res.Cluster)
+
+	return nil
+}
@@ -0,0 +1,300 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
+)
+
+// system mounts vault manages itself, they are never reported nor pruned
+var systemMounts = map[string]bool{
+	"sys/":       true,
+	"cubbyhole/": true,
+	"identity/":  true,
+}
+
+// mountPath normalizes a mount path the way sys/mounts reports it, eg "secret/"
+func mountPath(p string) string {
+	return strings.Trim(p, "/") + "/"
+}
+
+// TuneConfig holds the tunable settings of a mount, settings left empty are not managed
+type TuneConfig struct {
+	DefaultLeaseTTL   string `yaml:"default_lease_ttl,omitempty" json:"default_lease_ttl,omitempty"`
+	MaxLeaseTTL       string `yaml:"max_lease_ttl,omitempty" json:"max_lease_ttl,omitempty"`
+	ListingVisibility string `yaml:"listing_visibility,omitempty" json:"listing_visibility,omitempty"`
+	// the audit_non_hmac lists are managed as soon as they are declared, an empty list clears them
+	AuditNonHMACRequestKeys  []string `yaml:"audit_non_hmac_request_keys,omitempty" json:"audit_non_hmac_request_keys,omitempty"`
+	AuditNonHMACResponseKeys []string `yaml:"audit_non_hmac_response_keys,omitempty" json:"audit_non_hmac_response_keys,omitempty"`
+}
+
+// validate checks the tunable settings
+func (t TuneConfig) validate() error {
+	if _, err := durationSeconds(t.DefaultLeaseTTL); err != nil {
+		errm := fmt.Sprintf("invalid default_lease_ttl %v", t.DefaultLeaseTTL)
+		return errors.New(errm)
+	}
+	if _, err := durationSeconds(t.MaxLeaseTTL); err != nil {
+		errm := fmt.Sprintf("invalid max_lease_ttl %v", t.MaxLeaseTTL)
+		return errors.New(errm)
+	}
+	switch t.ListingVisibility {
+	case "", "hidden", "unauth":
+	default:
+		errm := fmt.Sprintf("invalid listing_visibility %v, it must be hidden or unauth", t.ListingVisibility)
+		return errors.New(errm)
+	}
+	return nil
+}
+
+// input returns the config sent along with a new mount
+func (t TuneConfig) input() api.MountConfigInput {
+	return api.MountConfigInput{
+		DefaultLeaseTTL:          t.DefaultLeaseTTL,
+		MaxLeaseTTL:              t.MaxLeaseTTL,
+		ListingVisibility:        t.ListingVisibility,
+		AuditNonHMACRequestKeys:  t.AuditNonHMACRequestKeys,
+		AuditNonHMACResponseKeys: t.AuditNonHMACResponseKeys,
+	}
+}
+
+// diff returns the tune request needed to bring the live settings in line, nil when nothing differs.
+// Settings that are not declared are left alone.
+func (t TuneConfig) diff(live api.MountConfig) (*api.MountTuneInput, []string) {
+
+	in := &api.MountTuneInput{}
+	var details []string
+	if d, _ := durationSeconds(t.DefaultLeaseTTL); t.DefaultLeaseTTL != "" && d != live.DefaultLeaseTTL {
+		in.DefaultLeaseTTL = t.DefaultLeaseTTL
+		details = append(details, fmt.Sprintf("default_lease_ttl %vs -> %v", live.DefaultLeaseTTL, t.DefaultLeaseTTL))
+	}
+	if m, _ := durationSeconds(t.MaxLeaseTTL); t.MaxLeaseTTL != "" && m != live.MaxLeaseTTL {
+		in.MaxLeaseTTL = t.MaxLeaseTTL
+		details = append(details, fmt.Sprintf("max_lease_ttl %vs -> %v", live.MaxLeaseTTL, t.MaxLeaseTTL))
+	}
+	if t.ListingVisibility != "" && t.ListingVisibility != live.ListingVisibility {
+		in.ListingVisibility = t.ListingVisibility
+		details = append(details, fmt.Sprintf("listing_visibility %q -> %q", live.ListingVisibility, t.ListingVisibility))
+	}
+	if t.AuditNonHMACRequestKeys != nil && !sameKeys(t.AuditNonHMACRequestKeys, live.AuditNonHMACRequestKeys) {
+		in.AuditNonHMACRequestKeys = nonNilKeys(t.AuditNonHMACRequestKeys)
+		details = append(details, fmt.Sprintf("audit_non_hmac_request_keys %v -> %v", live.AuditNonHMACRequestKeys, t.AuditNonHMACRequestKeys))
+	}
+	if t.AuditNonHMACResponseKeys != nil && !sameKeys(t.AuditNonHMACResponseKeys, live.AuditNonHMACResponseKeys) {
+		in.AuditNonHMACResponseKeys = nonNilKeys(t.AuditNonHMACResponseKeys)
+		details = append(details, fmt.Sprintf("audit_non_hmac_response_keys %v -> %v", live.AuditNonHMACResponseKeys, t.AuditNonHMACResponseKeys))
+	}
+	if len(details) == 0 {
+		return nil, nil
+	}
+
+	return in, details
+}
+
+// sameKeys compares two key lists ignoring their order
+func sameKeys(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	sa := append([]string(nil), a...)
+	sb := append([]string(nil), b...)
+	sort.Strings(sa)
+	sort.Strings(sb)
+	for i := range sa {
+		if sa[i] != sb[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// nonNilKeys keeps an empty key list in the tune request, vault clears the list when it receives a single empty key
+func nonNilKeys(k []string) []string {
+	if len(k) == 0 {
+		return []string{""}
+	}
+	return k
+}
+
+// validateBackends checks the vault_backends section
+func (g *Config) validateBackends() error {
+
+	paths := make(map[string]bool)
+	for i, b := range g.Backends {
+		p := mountPath(b.Mountpath)
+		if b.Type == "" || p == "/" {
+			errm := fmt.Sprintf("vault_backends entry %v needs a type and a mountpath", i)
+			return errors.New(errm)
+		}
+		if systemMounts[p] {
+			errm := fmt.Sprintf("vault_backends entry %v uses the reserved mountpath %v", i, p)
+			return errors.New(errm)
+		}
+		if paths[p] {
+			errm := fmt.Sprintf("mountpath %v is declared more than once in vault_backends", p)
+			return errors.New(errm)
+		}
+		paths[p] = true
+		if err := b.Config.validate(); err != nil {
+			errm := fmt.Sprintf("secret backend %v: %v", p, err)
+			return errors.New(errm)
+		}
+	}
+
+	if err := g.validatePKI(); err != nil {
+		return err
+	}
+
+	return g.validateTransitKeys()
+}
+
+// diffMounts compares the declared secret backends with the live mounts of a cluster
+func diffMounts(vgc Config, live map[string]*api.MountOutput) []change {
+
+	var changes []change
+	declared := make(map[string]bool)
+	for _, b := range vgc.Backends {
+		b := b
+		path := mountPath(b.Mountpath)
+		declared[path] = true
+
+		m, ok := live[path]
+		if !ok {
+			changes = append(changes, change{
+				kind:   "mount",
+				action: actionAdd,
+				name:   path,
+				detail: "type " + b.Type,
+				apply: func(ctx context.Context, c *api.Client) error {
+					in := &api.MountInput{
+						Type:        b.Type,
+						Description: b.Description,
+						Config:      b.Config.input(),
+						Options:     b.Options,
+						Local:       b.Local,
+						SealWrap:    b.SealWrap,
+					}
+					return c.Mount(ctx, path, in)
+				},
+			})
+			continue
+		}
+		if m.Type != b.Type {
+			changes = append(changes, change{
+				kind:   "mount",
+				action: actionChange,
+				name:   path,
+				detail: fmt.Sprintf("type %v is mounted where %v is declared, remounting would destroy its data", m.Type, b.Type),
+			})
+			continue
+		}
+		// step: local and seal_wrap are fixed when mounting, they can't be tuned
+		if m.Local != b.Local {
+			changes = append(changes, change{
+				kind:   "mount",
+				action: actionChange,
+				name:   path,
+				detail: fmt.Sprintf("local %v -> %v can only be set by remounting, which would destroy its data", m.Local, b.Local),
+			})
+		}
+		if m.SealWrap != b.SealWrap {
+			changes = append(changes, change{
+				kind:   "mount",
+				action: actionChange,
+				name:   path,
+				detail: fmt.Sprintf("seal_wrap %v -> %v can only be set by remounting, which would destroy its data", m.SealWrap, b.SealWrap),
+			})
+		}
+
+		in, details := b.Config.diff(m.Config)
+		if in == nil {
+			in = &api.MountTuneInput{}
+		}
+		if m.Description != b.Description {
+			desc := b.Description
+			in.Description = &desc
+			details = append([]string{fmt.Sprintf("description %q -> %q", m.Description, b.Description)}, details...)
+		}
+		var opts []string
+		for k := range b.Options {
+			opts = append(opts, k)
+		}
+		sort.Strings(opts)
+		for _, k := range opts {
+			if lv, ok := m.Options[k]; !ok || lv != b.Options[k] {
+				if in.Options == nil {
+					in.Options = make(map[string]string)
+				}
+				in.Options[k] = b.Options[k]
+				details = append(details, fmt.Sprintf("options.%v %q -> %q", k, lv, b.Options[k]))
+			}
+		}
+		if len(details) != 0 {
+			changes = append(changes, change{
+				kind:   "mount",
+				action: actionChange,
+				name:   path,
+				detail: strings.Join(details, ", "),
+				apply: func(ctx context.Context, c *api.Client) error {
+					return c.TuneMount(ctx, path, in)
+				},
+			})
+		}
+	}
+
+	var unmanaged []string
+	for path := range live {
+		if !declared[path] && !systemMounts[path] {
+			unmanaged = append(unmanaged, path)
+		}
+	}
+	sort.Strings(unmanaged)
+	for _, path := range unmanaged {
+		path := path
+		ch := change{
+			kind:   "mount",
+			action: actionUnmanaged,
+			name:   path,
+			detail: "type " + live[path].Type + " is not declared in vault_backends",
+		}
+		if vgc.MountPrune {
+			ch.action = actionRemove
+			ch.apply = func(ctx context.Context, c *api.Client) error {
+				return c.Unmount(ctx, path)
+			}
+		}
+		changes = append(changes, ch)
+	}
+
+	return changes
+}
+
+// mountChanges reads the live mounts of a cluster and compares them with the declared secret backends
+func mountChanges(ctx context.Context, vgc Config, c *api.Client, cluster string) ([]change, error) {
+
+	live, err := c.ListMounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffMounts(vgc, live), nil
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/stefancocora/vaultguard/pkg/secret"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const defaultPGPPassphraseEnv = "VAULTGUARD_PGP_PASSPHRASE"
+
+// validateCustodians checks the custodian config against the init settings
+func (g *Config) validateCustodians() error {
+
+	if len(g.Custodians) == 0 {
+		if g.CustodianMode {
+			return errors.New("custodian_mode needs at least one custodian")
+		}
+		return nil
+	}
+
+	if g.Init && len(g.Custodians) != g.SecretShares {
+		errm := fmt.Sprintf("the number of custodians (%v) must match secret_shares (%v)", len(g.Custodians), g.SecretShares)
+		return errors.New(errm)
+	}
+
+	held := 0
+	names := make(map[string]bool)
+	for i, c := range g.Custodians {
+		if c.Name == "" || names[c.Name] {
+			errm := fmt.Sprintf("custodian %v needs a unique name", i)
+			return errors.New(errm)
+		}
+		names[c.Name] = true
+		if c.PGPKey == "" {
+			errm := fmt.Sprintf("custodian %v has no pgp_key", c.Name)
+			return errors.New(errm)
+		}
+		if c.Vaultguard {
+			held++
+			continue
+		}
+		if c.Output == "" {
+			errm := fmt.Sprintf("custodian %v has no output", c.Name)
+			return errors.New(errm)
+		}
+	}
+
+	if held != 0 && !g.CustodianMode {
+		return errors.New("custodians marked as vaultguard need custodian_mode")
+	}
+	if g.CustodianMode {
+		if held == 0 {
+			return errors.New("custodian_mode needs at least one custodian marked as vaultguard")
+		}
+		if g.PGPPrivateKey == "" {
+			return errors.New("custodian_mode needs pgp_private_key to decrypt the vaultguard shares")
+		}
+	}
+
+	return nil
+}
+
+// pgpKeys reads the custodian public keys in the order sys/init expects them
+func (g *Config) pgpKeys() ([]string, error) {
+
+	var keys []string
+	for _, c := range g.Custodians {
+		k, err := readPGPPublicKey(c.PGPKey)
+		if err != nil {
+			errm := fmt.Sprintf("custodian %v: %v", c.Name, err)
+			return nil, errors.New(errm)
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+// readPGPPublicKey converts an armored PGP public key file into the base64 encoded binary key sys/init expects
+func readPGPPublicKey(path string) (string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	blk, err := armor.Decode(f)
+	if err != nil {
+		errm := fmt.Sprintf("unable to decode armored PGP key %v: %v", path, err)
+		return "", errors.New(errm)
+	}
+	if blk.Type != openpgp.PublicKeyType {
+		errm := fmt.Sprintf("%v is a %v, not a PGP public key", path, blk.Type)
+		return "", errors.New(errm)
+	}
+	b, err := ioutil.ReadAll(blk.Body)
+	if err != nil {
+		return "", err
+	}
+
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(b))
+	if err != nil {
+		errm := fmt.Sprintf("unable to parse PGP public key %v: %v", path, err)
+		return "", errors.New(errm)
+	}
+	if len(el) != 1 {
+		errm := fmt.Sprintf("%v must contain exactly one PGP public key, found %v", path, len(el))
+		return "", errors.New(errm)
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// vaultguardKeyRing reads and unlocks the vaultguard PGP private key used in custodian mode
+func (g *Config) vaultguardKeyRing() (openpgp.EntityList, error) {
+
+	f, err := os.Open(g.PGPPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	el, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		errm := fmt.Sprintf("unable to read PGP private key %v: %v", g.PGPPrivateKey, err)
+		return nil, errors.New(errm)
+	}
+
+	env := g.PGPPassphraseEnv
+	if env == "" {
+		env = defaultPGPPassphraseEnv
+	}
+	pass := []byte(os.Getenv(env))
+	defer secret.Zero(pass)
+
+	for _, e := range el {
+		if e.PrivateKey == nil {
+			errm := fmt.Sprintf("%v does not contain a PGP private key", g.PGPPrivateKey)
+			return nil, errors.New(errm)
+		}
+		if e.PrivateKey.Encrypted {
+			if err := e.PrivateKey.Decrypt(pass); err != nil {
+				errm := fmt.Sprintf("unable to unlock PGP private key %v with the passphrase from %v", g.PGPPrivateKey, env)
+				return nil, errors.New(errm)
+			}
+		}
+		for _, sk := range e.Subkeys {
+			if sk.PrivateKey != nil && sk.PrivateKey.Encrypted {
+				if err := sk.PrivateKey.Decrypt(pass); err != nil {
+					errm := fmt.Sprintf("unable to unlock a PGP private subkey of %v with the passphrase from %v", g.PGPPrivateKey, env)
+					return nil, errors.New(errm)
+				}
+			}
+		}
+	}
+
+	return el, nil
+}
+
+// decryptShare decrypts a base64 encoded PGP encrypted share, vault encrypts the hex encoded share
+func decryptShare(kr openpgp.EntityList, b64 string) (string, error) {
+
+	b, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", err
+	}
+	md, err := openpgp.ReadMessage(bytes.NewReader(b), kr, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	pt, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return "", err
+	}
+	defer secret.Zero(pt)
+
+	return string(bytes.TrimSpace(pt)), nil
+}
+
+// distributeShares writes every PGP encrypted share to the output of its custodian and
+// replaces the shares of the init result with the ones vaultguard is allowed to hold.
+// Outside custodian mode vaultguard holds no shares at all.
+// When a share could not be handed out the encrypted shares are left in the result so that they are stored with it.
+func distributeShares(vgc Config, res *InitResult, id WorkerID) error {
+
+	if len(res.KeysB64) != len(vgc.Custodians) {
+		errm := fmt.Sprintf("%v%v: vault returned %v shares for %v custodians", id.Name, id.ID, len(res.KeysB64), len(vgc.Custodians))
+		return errors.New(errm)
+	}
+
+	var kr openpgp.EntityList
+	if vgc.CustodianMode {
+		k, err := vgc.vaultguardKeyRing()
+		if err != nil {
+			return err
+		}
+		kr = k
+	}
+
+	var held []string
+	var failed []string
+	for i, c := range vgc.Custodians {
+		if c.Output != "" {
+			out := shareOutput(c, res.Cluster)
+			if err := writeShare(out, res.KeysB64[i]); err != nil {
+				log.Printf("%v%v: unable to write the share of custodian %v to %v: %v", id.Name, id.ID, c.Name, out, err)
+				failed = append(failed, c.Name)
+			} else {
+				log.Printf("%v%v: wrote the encrypted share of custodian %v to %v", id.Name, id.ID, c.Name, out)
+			}
+		}
+		if c.Vaultguard && vgc.CustodianMode {
+			s, err := decryptShare(kr, res.KeysB64[i])
+			if err != nil {
+				log.Printf("%v%v: unable to decrypt the share of custodian %v: %v", id.Name, id.ID, c.Name, err)
+				failed = append(failed, c.Name)
+				continue
+			}
+			held = append(held, s)
+		}
+	}
+
+	res.Keys = held
+
+	if len(failed) != 0 {
+		errm := fmt.Sprintf("%v%v: the shares of custodians %v of cluster %v could not be handed out", id.Name, id.ID, failed, res.Cluster)
+		return errors.New(errm)
+	}
+	res.KeysB64 = nil
+
+	return nil
+}
+
+// shareOutput is the file the encrypted share of a custodian for a cluster is written to
+func shareOutput(c Custodian, cluster string) string {
+	return filepath.Join(c.Output, cluster)
+}
+
+// writeShare writes an encrypted share to a custodian output file without ever overwriting an older one
+func writeShare(path string, share string) error {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(share + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
+)
+
+const (
+	pkiRoot         = "root"
+	pkiIntermediate = "intermediate"
+)
+
+// PKIConfig bootstraps the CA of a pki backend
+type PKIConfig struct {
+	// Role is root for a root CA, or intermediate for a CA signed by the pki backend mounted at Issuer
+	Role       string `yaml:"role" json:"role"`
+	CommonName string `yaml:"common_name" json:"common_name"`
+	TTL        string `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+	KeyType    string `yaml:"key_type,omitempty" json:"key_type,omitempty"`
+	KeyBits    int    `yaml:"key_bits,omitempty" json:"key_bits,omitempty"`
+	// External replaces the internal root with a CA signed outside vault: the CSR is written to CSRFile
+	// and the certificate signed from it is imported once it shows up in CertFile.
+	// Every cluster has its own CA, so the cluster name is added as a directory, eg ca/root.csr becomes ca/<cluster>/root.csr
+	External bool   `yaml:"external,omitempty" json:"external,omitempty"`
+	CSRFile  string `yaml:"csr_file,omitempty" json:"csr_file,omitempty"`
+	CertFile string `yaml:"cert_file,omitempty" json:"cert_file,omitempty"`
+	Issuer   string `yaml:"issuer,omitempty" json:"issuer,omitempty"`
+	// written to config/urls when any of them is declared
+	IssuingCertificates   []string `yaml:"issuing_certificates,omitempty" json:"issuing_certificates,omitempty"`
+	CRLDistributionPoints []string `yaml:"crl_distribution_points,omitempty" json:"crl_distribution_points,omitempty"`
+	OCSPServers           []string `yaml:"ocsp_servers,omitempty" json:"ocsp_servers,omitempty"`
+}
+
+// validatePKI checks the pki settings of the secret backends
+func (g *Config) validatePKI() error {
+
+	issuers := make(map[string]bool)
+	for _, b := range g.Backends {
+		if b.PKI != nil {
+			issuers[mountPath(b.Mountpath)] = true
+		}
+	}
+
+	for _, b := range g.Backends {
+		p := b.PKI
+		if p == nil {
+			continue
+		}
+		path := mountPath(b.Mountpath)
+		if b.Type != "pki" {
+			errm := fmt.Sprintf("secret backend %v: pki is only valid on pki backends", path)
+			return errors.New(errm)
+		}
+		if p.CommonName == "" {
+			errm := fmt.Sprintf("secret backend %v: pki needs a common_name", path)
+			return errors.New(errm)
+		}
+		if _, err := durationSeconds(p.TTL); err != nil {
+			errm := fmt.Sprintf("secret backend %v: invalid pki ttl %v", path, p.TTL)
+			return errors.New(errm)
+		}
+		switch p.Role {
+		case pkiRoot:
+			if p.Issuer != "" {
+				errm := fmt.Sprintf("secret backend %v: a root CA has no issuer", path)
+				return errors.New(errm)
+			}
+			if p.External && (p.CSRFile == "" || p.CertFile == "") {
+				errm := fmt.Sprintf("secret backend %v: an external root needs csr_file and cert_file", path)
+				return errors.New(errm)
+			}
+		case pkiIntermediate:
+			if p.External {
+				errm := fmt.Sprintf("secret backend %v: external is only valid on a root", path)
+				return errors.New(errm)
+			}
+			issuer := mountPath(p.Issuer)
+			if issuer == path || !issuers[issuer] {
+				errm := fmt.Sprintf("secret backend %v: issuer %v is not another pki backend with pki settings", path, p.Issuer)
+				return errors.New(errm)
+			}
+		default:
+			errm := fmt.Sprintf("secret backend %v: pki role must be %v or %v", path, pkiRoot, pkiIntermediate)
+			return errors.New(errm)
+		}
+	}
+
+	return nil
+}
+
+// keyParams returns the settings shared by every CA generation request
+func (p PKIConfig) keyParams() map[string]interface{} {
+
+	data := map[string]interface{}{"common_name": p.CommonName}
+	if p.TTL != "" {
+		data["ttl"] = p.TTL
+	}
+	if p.KeyType != "" {
+		data["key_type"] = p.KeyType
+	}
+	if p.KeyBits != 0 {
+		data["key_bits"] = p.KeyBits
+	}
+
+	return data
+}
+
+// urls returns the declared config/urls, nil when none are declared
+func (p PKIConfig) urls() map[string]interface{} {
+
+	if p.IssuingCertificates == nil && p.CRLDistributionPoints == nil && p.OCSPServers == nil {
+		return nil
+	}
+	data := make(map[string]interface{})
+	if p.IssuingCertificates != nil {
+		data["issuing_certificates"] = p.IssuingCertificates
+	}
+	if p.CRLDistributionPoints != nil {
+		data["crl_distribution_points"] = p.CRLDistributionPoints
+	}
+	if p.OCSPServers != nil {
+		data["ocsp_servers"] = p.OCSPServers
+	}
+
+	return data
+}
+
+// hasCA reports if a pki backend already holds a CA certificate, which is what keeps the generation idempotent
+func hasCA(ctx context.Context, c *api.Client, path string) (bool, error) {
+
+	data, err := c.Read(ctx, path+"cert/ca")
+	if err != nil {
+		return false, err
+	}
+	cert, _ := data["certificate"].(string)
+
+	return strings.TrimSpace(cert) != "", nil
+}
+
+// pkiChanges reads the CA and urls of the declared pki backends and returns what is missing.
+// Roots come first so that the intermediates they sign are generated after them.
+func pkiChanges(ctx context.Context, vgc Config, c *api.Client, cluster string) ([]change, error) {
+
+	live, err := c.ListMounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []change
+	for _, role := range []string{pkiRoot, pkiIntermediate} {
+		for _, b := range vgc.Backends {
+			if b.PKI == nil || b.PKI.Role != role {
+				continue
+			}
+			path := mountPath(b.Mountpath)
+			mounted := false
+			if m, ok := live[path]; ok && m.Type == b.Type {
+				mounted = true
+			}
+
+			ca := false
+			if mounted {
+				if ca, err = hasCA(ctx, c, path); err != nil {
+					errm := fmt.Sprintf("unable to read the CA of %v: %v", path, err)
+					return nil, errors.New(errm)
+				}
+			}
+			if !ca {
+				ch, err := caChange(cluster, path, *b.PKI)
+				if err != nil {
+					return nil, err
+				}
+				if ch != nil {
+					changes = append(changes, *ch)
+				}
+			}
+
+			urls := b.PKI.urls()
+			if urls == nil {
+				continue
+			}
+			var cur map[string]interface{}
+			if mounted {
+				if cur, err = c.Read(ctx, path+"config/urls"); err != nil {
+					errm := fmt.Sprintf("unable to read the urls of %v: %v", path, err)
+					return nil, errors.New(errm)
+				}
+			}
+			write := func(ctx context.Context, c *api.Client) error {
+				_, err := c.Write(ctx, path+"config/urls", urls)
+				return err
+			}
+			if cur == nil {
+				changes = append(changes, change{kind: "pki-urls", action: actionAdd, name: path + "config/urls", apply: write})
+			} else if keys := diffData(urls, cur); len(keys) != 0 {
+				changes = append(changes, change{kind: "pki-urls", action: actionChange, name: path + "config/urls", detail: "keys " + strings.Join(keys, ","), apply: write})
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// caChange returns the change that gives a pki backend its CA, nil while an external root waits for its signed certificate
+func caChange(cluster string, path string, p PKIConfig) (*change, error) {
+
+	switch {
+	case p.Role == pkiIntermediate:
+		issuer := mountPath(p.Issuer)
+		return &change{
+			kind:   "pki-ca",
+			action: actionAdd,
+			name:   path,
+			detail: "intermediate " + p.CommonName + " signed by " + issuer,
+			apply: func(ctx context.Context, c *api.Client) error {
+				return signIntermediate(ctx, c, path, issuer, p)
+			},
+		}, nil
+	case !p.External:
+		return &change{
+			kind:   "pki-ca",
+			action: actionAdd,
+			name:   path,
+			detail: "internal root " + p.CommonName,
+			apply: func(ctx context.Context, c *api.Client) error {
+				_, err := c.Write(ctx, path+"root/generate/internal", p.keyParams())
+				return err
+			},
+		}, nil
+	}
+
+	// step: a new CSR would replace the pending private key, so it is only generated once per cluster
+	csrFile, certFile := clusterFile(p.CSRFile, cluster), clusterFile(p.CertFile, cluster)
+	if _, err := os.Stat(certFile); err == nil {
+		return &change{
+			kind:   "pki-ca",
+			action: actionAdd,
+			name:   path,
+			detail: "external root " + p.CommonName + " from " + certFile,
+			apply: func(ctx context.Context, c *api.Client) error {
+				cert, err := ioutil.ReadFile(certFile)
+				if err != nil {
+					return err
+				}
+				_, err = c.Write(ctx, path+"intermediate/set-signed", map[string]interface{}{"certificate": string(cert)})
+				return err
+			},
+		}, nil
+	}
+	if _, err := os.Stat(csrFile); err == nil {
+		return &change{
+			kind:   "pki-ca",
+			action: actionAdd,
+			name:   path,
+			detail: "external root " + p.CommonName + " waits for the certificate signed from " + csrFile + " in " + certFile,
+		}, nil
+	}
+
+	return &change{
+		kind:   "pki-ca",
+		action: actionAdd,
+		name:   path,
+		detail: "CSR for external root " + p.CommonName + " written to " + csrFile,
+		apply: func(ctx context.Context, c *api.Client) error {
+			data, err := c.Write(ctx, path+"intermediate/generate/internal", p.keyParams())
+			if err != nil {
+				return err
+			}
+			csr, _ := data["csr"].(string)
+			if csr == "" {
+				return errors.New("vault returned no CSR")
+			}
+			return writeFileAtomic(csrFile, []byte(csr+"\n"), 0644)
+		},
+	}, nil
+}
+
+// clusterFile adds the cluster as the last directory of a file path
+func clusterFile(path string, cluster string) string {
+	return filepath.Join(filepath.Dir(path), cluster, filepath.Base(path))
+}
+
+// signIntermediate generates an intermediate CA in path, signs it with the CA in issuer and imports the certificate
+func signIntermediate(ctx context.Context, c *api.Client, path string, issuer string, p PKIConfig) error {
+
+	data, err := c.Write(ctx, path+"intermediate/generate/internal", p.keyParams())
+	if err != nil {
+		return err
+	}
+	csr, _ := data["csr"].(string)
+	if csr == "" {
+		return errors.New("vault returned no CSR")
+	}
+
+	req := map[string]interface{}{
+		"csr":         csr,
+		"common_name": p.CommonName,
+		"format":      "pem_bundle",
+	}
+	if p.TTL != "" {
+		req["ttl"] = p.TTL
+	}
+	signed, err := c.Write(ctx, issuer+"root/sign-intermediate", req)
+	if err != nil {
+		errm := fmt.Sprintf("unable to sign the intermediate with %v: %v", issuer, err)
+		return errors.New(errm)
+	}
+	cert, _ := signed["certificate"].(string)
+	if cert == "" {
+		errm := fmt.Sprintf("%v returned no certificate", issuer)
+		return errors.New(errm)
+	}
+	// step: import the chain so the intermediate serves its issuer too
+	if ca, ok := signed["issuing_ca"].(string); ok && ca != "" && !strings.Contains(cert, ca) {
+		cert = cert + "\n" + ca
+	}
+
+	_, err = c.Write(ctx, path+"intermediate/set-signed", map[string]interface{}{"certificate": cert})
+	return err
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ClusterPlan is the dry run of the reconciling phases against a single cluster
+type ClusterPlan struct {
+	Cluster string
+	Node    string
+	Err     error
+	changes []change
+}
+
+// Drift reports if the cluster differs from the config
+func (p ClusterPlan) Drift() bool {
+	return len(p.changes) != 0
+}
+
+// planPhases are the phases a plan covers, the others are left to configure
+var planPhases = map[string]bool{
+	"audit":    true,
+	"mount":    true,
+	"policies": true,
+	"auth":     true,
+}
+
+// planSymbols prefix the changes of a plan
+var planSymbols = map[string]string{
+	actionAdd:       "+",
+	actionChange:    "~",
+	actionRemove:    "-",
+	actionUnmanaged: "?",
+}
+
+// Write prints the plan of the cluster
+func (p ClusterPlan) Write(w io.Writer) {
+
+	fmt.Fprintf(w, "cluster %v", p.Cluster)
+	if p.Node != "" {
+		fmt.Fprintf(w, " (%v)", p.Node)
+	}
+	fmt.Fprintln(w, ":")
+	if p.Err != nil {
+		fmt.Fprintf(w, "  error: %v\n\n", p.Err)
+		return
+	}
+	if len(p.changes) == 0 {
+		fmt.Fprintf(w, "  no changes, the cluster matches the config\n\n")
+		return
+	}
+
+	count := make(map[string]int)
+	for _, ch := range p.changes {
+		fmt.Fprintf(w, "  %v %v\n", planSymbols[ch.action], ch)
+		count[ch.action]++
+	}
+	fmt.Fprintf(w, "  plan: %v to add, %v to change, %v to remove, %v unmanaged\n\n", count[actionAdd], count[actionChange], count[actionRemove], count[actionUnmanaged])
+}
+
+// Plan reads the live mounts, policies, auth methods and audit devices of every discovered cluster
+// with token and compares them with the config, without changing anything. Phases disabled in the config are skipped.
+func Plan(ctx context.Context, vgc Config, dv map[string][]string, token string) []ClusterPlan {
+
+	var clusters []string
+	for cl := range dv {
+		clusters = append(clusters, cl)
+	}
+	sort.Strings(clusters)
+
+	var plans []ClusterPlan
+	for _, cl := range clusters {
+		plans = append(plans, planCluster(ctx, vgc, cl, dv[cl], token))
+	}
+
+	return plans
+}
+
+func planCluster(ctx context.Context, vgc Config, cluster string, nodes []string, token string) ClusterPlan {
+
+	p := ClusterPlan{Cluster: cluster}
+
+	c, err := activeNode(ctx, vgc, cluster, nodes)
+	if err != nil {
+		errm := fmt.Sprintf("%v among %v", err, nodes)
+		p.Err = errors.New(errm)
+		return p
+	}
+	p.Node = c.Address()
+	c = c.WithToken(token)
+
+	for _, ph := range phases {
+		if !planPhases[ph.name] || !ph.enabled(vgc.GuardConfig) {
+			continue
+		}
+		changes, err := ph.changes(ctx, vgc, c, cluster)
+		if err != nil {
+			errm := fmt.Sprintf("unable to read the live %v state: %v", ph.name, err)
+			p.Err = errors.New(errm)
+			return p
+		}
+		p.changes = append(p.changes, changes...)
+	}
+
+	return p
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
+)
+
+// builtin policies are never written to nor deleted
+const (
+	policyRoot    = "root"
+	policyDefault = "default"
+)
+
+// the values vault accepts in the policy and capabilities fields of a path
+var (
+	policyLevels = map[string]bool{"deny": true, "read": true, "write": true, "sudo": true, "list": true}
+	capabilities = map[string]bool{"deny": true, "create": true, "read": true, "update": true, "delete": true, "list": true, "sudo": true}
+)
+
+// policyPath is a single path block of a policy
+type policyPath struct {
+	Policy       string   `hcl:"policy"`
+	Capabilities []string `hcl:"capabilities"`
+}
+
+// validatePolicies parses every declared policy so that an invalid one is rejected before anything is written
+func (g *Config) validatePolicies() error {
+
+	names := make(map[string]bool)
+	for i, p := range g.Policy {
+		if p.Name == "" || strings.ContainsAny(p.Name, "/ ") {
+			errm := fmt.Sprintf("vault_policies entry %v has an invalid name %q", i, p.Name)
+			return errors.New(errm)
+		}
+		if p.Name == policyRoot || p.Name == policyDefault {
+			errm := fmt.Sprintf("the builtin %v policy can't be declared in vault_policies", p.Name)
+			return errors.New(errm)
+		}
+		if names[p.Name] {
+			errm := fmt.Sprintf("policy %v is declared more than once in vault_policies", p.Name)
+			return errors.New(errm)
+		}
+		names[p.Name] = true
+		if err := parsePolicy(p.Policy); err != nil {
+			errm := fmt.Sprintf("policy %v is invalid: %v", p.Name, err)
+			return errors.New(errm)
+		}
+	}
+
+	return nil
+}
+
+// parsePolicy parses the HCL rules of a policy and checks its path blocks the way vault does
+func parsePolicy(rules string) error {
+
+	root, err := hcl.Parse(rules)
+	if err != nil {
+		return err
+	}
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return errors.New("the policy doesn't contain a root object")
+	}
+
+	for _, item := range list.Items {
+		if len(item.Keys) == 0 {
+			return errors.New("the policy contains an item without a key")
+		}
+		switch k := item.Keys[0].Token.Value(); k {
+		case "path", "name":
+		default:
+			errm := fmt.Sprintf("unexpected key %v", k)
+			return errors.New(errm)
+		}
+	}
+
+	paths := list.Filter("path")
+	if len(paths.Items) == 0 {
+		return errors.New("the policy has no path blocks")
+	}
+	for _, item := range paths.Items {
+		if len(item.Keys) != 1 {
+			return errors.New("every path block needs exactly one path")
+		}
+		path, _ := item.Keys[0].Token.Value().(string)
+
+		var pp policyPath
+		if err := hcl.DecodeObject(&pp, item.Val); err != nil {
+			errm := fmt.Sprintf("path %q: %v", path, err)
+			return errors.New(errm)
+		}
+		if pp.Policy == "" && len(pp.Capabilities) == 0 {
+			errm := fmt.Sprintf("path %q needs a policy or capabilities", path)
+			return errors.New(errm)
+		}
+		if pp.Policy != "" && !policyLevels[pp.Policy] {
+			errm := fmt.Sprintf("path %q has an invalid policy %q", path, pp.Policy)
+			return errors.New(errm)
+		}
+		for _, c := range pp.Capabilities {
+			if !capabilities[c] {
+				errm := fmt.Sprintf("path %q has an invalid capability %q", path, c)
+				return errors.New(errm)
+			}
+		}
+	}
+
+	return nil
+}
+
+// diffPolicies compares the declared policies with the live ones, live maps a policy name to its rules
+func diffPolicies(vgc Config, live map[string]string) []change {
+
+	var changes []change
+	declared := make(map[string]bool)
+	for _, p := range vgc.Policy {
+		p := p
+		declared[p.Name] = true
+		put := func(ctx context.Context, c *api.Client) error {
+			return c.PutPolicy(ctx, p.Name, p.Policy)
+		}
+
+		rules, ok := live[p.Name]
+		switch {
+		case !ok:
+			changes = append(changes, change{kind: "policy", action: actionAdd, name: p.Name, apply: put})
+		case strings.TrimSpace(rules) != strings.TrimSpace(p.Policy):
+			changes = append(changes, change{kind: "policy", action: actionChange, name: p.Name, detail: "rules differ", apply: put})
+		}
+	}
+
+	var unmanaged []string
+	for name := range live {
+		if !declared[name] && name != policyRoot && name != policyDefault {
+			unmanaged = append(unmanaged, name)
+		}
+	}
+	sort.Strings(unmanaged)
+	for _, name := range unmanaged {
+		name := name
+		ch := change{
+			kind:   "policy",
+			action: actionUnmanaged,
+			name:   name,
+			detail: "not declared in vault_policies",
+		}
+		if vgc.PolicyPrune {
+			ch.action = actionRemove
+			ch.apply = func(ctx context.Context, c *api.Client) error {
+				return c.DeletePolicy(ctx, name)
+			}
+		}
+		changes = append(changes, ch)
+	}
+
+	return changes
+}
+
+// livePolicies reads the rules of every policy of a cluster apart from root, which has none
+func livePolicies(ctx context.Context, c *api.Client) (map[string]string, error) {
+
+	names, err := c.ListPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]string)
+	for _, name := range names {
+		if name == policyRoot {
+			continue
+		}
+		rules, err := c.GetPolicy(ctx, name)
+		if err != nil {
+			errm := fmt.Sprintf("unable to read policy %v: %v", name, err)
+			return nil, errors.New(errm)
+		}
+		live[name] = rules
+	}
+
+	return live, nil
+}
+
+// policyChanges reads the live policies of a cluster and compares them with the declared ones
+func policyChanges(ctx context.Context, vgc Config, c *api.Client, cluster string) ([]change, error) {
+
+	live, err := livePolicies(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffPolicies(vgc, live), nil
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultReconcileTokenEnv = "VAULT_TOKEN"
+
+// Reconcile is the config of the periodic drift detection, it is disabled without an interval
+type Reconcile struct {
+	Interval string `yaml:"interval,omitempty" json:"interval,omitempty"`
+	// TokenEnv names the env var holding the token the live state is read with, VAULT_TOKEN by default.
+	// Corrections are applied with the same token.
+	TokenEnv string `yaml:"token_env,omitempty" json:"token_env,omitempty"`
+	// Correct lists the phases whose drift is corrected, eg mount, policies and auth, drift of the others is only reported
+	Correct []string `yaml:"correct,omitempty" json:"correct,omitempty"`
+}
+
+// driftChange is a single difference between the config and a cluster
+type driftChange struct {
+	Kind      string `json:"kind"`
+	Action    string `json:"action"`
+	Name      string `json:"name"`
+	Detail    string `json:"detail,omitempty"`
+	Corrected bool   `json:"corrected,omitempty"`
+}
+
+// clusterDrift is the outcome of the last reconcile of a cluster
+type clusterDrift struct {
+	Checked time.Time     `json:"checked"`
+	Node    string        `json:"node,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Changes []driftChange `json:"changes"`
+}
+
+// ReconcileEnabled reports if the periodic drift detection is configured
+func (g *Config) ReconcileEnabled() bool {
+	return g.Reconcile.Interval != ""
+}
+
+// validateReconcile checks the reconcile config
+func (g *Config) validateReconcile() error {
+
+	if !g.ReconcileEnabled() {
+		return nil
+	}
+	if _, err := g.reconcileInterval(); err != nil {
+		return err
+	}
+	if os.Getenv(g.reconcileTokenEnv()) == "" {
+		errm := fmt.Sprintf("reconcile: the token env var %v is empty", g.reconcileTokenEnv())
+		return errors.New(errm)
+	}
+	for _, name := range g.Reconcile.Correct {
+		ps := phasesNamed(name)
+		if len(ps) == 0 || ps[0].changes == nil {
+			errm := fmt.Sprintf("reconcile: %v is not a phase whose drift can be corrected", name)
+			return errors.New(errm)
+		}
+		if !ps[0].enabled(g.GuardConfig) {
+			errm := fmt.Sprintf("reconcile: drift of the %v phase is only corrected when the phase is enabled", name)
+			return errors.New(errm)
+		}
+	}
+
+	return nil
+}
+
+func (g *Config) reconcileInterval() (time.Duration, error) {
+	d, err := time.ParseDuration(g.Reconcile.Interval)
+	if err != nil || d <= 0 {
+		errm := fmt.Sprintf("reconcile: invalid interval %v", g.Reconcile.Interval)
+		return 0, errors.New(errm)
+	}
+	return d, nil
+}
+
+func (g *Config) reconcileTokenEnv() string {
+	if g.Reconcile.TokenEnv == "" {
+		return defaultReconcileTokenEnv
+	}
+	return g.Reconcile.TokenEnv
+}
+
+// RunReconcile compares every discovered cluster with the config on an interval.
+// Drift is logged and published in st, the drift of the phases listed in reconcile.correct is corrected.
+// The nodes are discovered again with rediscover on every tick since they come and go, eg when ECS replaces a task.
+func RunReconcile(ctx context.Context, vgc Config, wg *sync.WaitGroup, retErrCh chan error, dvCh chan map[string][]string, rediscover func() map[string][]string, st *Status, id WorkerID) error {
+
+	defer wg.Done()
+	defer log.Printf("%v%v: worker shutdown complete", id.Name, id.ID)
+
+	var dv map[string][]string
+	select {
+	case <-ctx.Done():
+		log.Printf("%v%v: caller has asked us to stop processing work; shutting down.", id.Name, id.ID)
+		return nil
+	case dv = <-dvCh:
+	}
+	log.Printf("%v%v: received discovered vault endpoints: %v", id.Name, id.ID, dv)
+
+	interval, err := vgc.reconcileInterval()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	token := os.Getenv(vgc.reconcileTokenEnv())
+	correct := make(map[string]bool)
+	for _, name := range vgc.Reconcile.Correct {
+		correct[name] = true
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("%v%v: caller has asked us to stop processing work; shutting down.", id.Name, id.ID)
+			return nil
+		case <-ticker.C:
+		}
+
+		// step: a cluster that is no longer discovered is reported rather than checked at its old addresses
+		fresh := rediscover()
+		for cl := range dv {
+			if _, ok := fresh[cl]; !ok {
+				fresh[cl] = nil
+			}
+		}
+		dv = fresh
+		if dbgVaultPkg {
+			log.Printf("%v%v: rediscovered vault endpoints: %v", id.Name, id.ID, dv)
+		}
+
+		var clusters []string
+		for cl := range dv {
+			clusters = append(clusters, cl)
+		}
+		sort.Strings(clusters)
+
+		for _, cl := range clusters {
+			if len(dv[cl]) == 0 {
+				d := clusterDrift{Checked: time.Now().UTC(), Error: "no vault nodes discovered", Changes: []driftChange{}}
+				st.setDrift(cl, d)
+				errm := fmt.Sprintf("%v%v: unable to reconcile cluster %v: %v", id.Name, id.ID, cl, d.Error)
+				sendErr(ctx, retErrCh, errors.New(errm))
+				continue
+			}
+			d := reconcileCluster(ctx, vgc, cl, dv[cl], token, correct, id)
+			st.setDrift(cl, d)
+			if d.Error != "" {
+				errm := fmt.Sprintf("%v%v: unable to reconcile cluster %v: %v", id.Name, id.ID, cl, d.Error)
+				sendErr(ctx, retErrCh, errors.New(errm))
+			}
+		}
+	}
+}
+
+// reconcileCluster reads the live state of a cluster, logs its drift and corrects the drift of the phases in correct
+func reconcileCluster(ctx context.Context, vgc Config, cluster string, nodes []string, token string, correct map[string]bool, id WorkerID) clusterDrift {
+
+	d := clusterDrift{Checked: time.Now().UTC(), Changes: []driftChange{}}
+
+	c, err := activeNode(ctx, vgc, cluster, nodes)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	d.Node = c.Address()
+	c = c.WithToken(token)
+
+	var failed []string
+	for _, p := range phases {
+		// step: the phases configure doesn't run are neither read nor corrected
+		if p.changes == nil || !p.enabled(vgc.GuardConfig) {
+			continue
+		}
+		changes, err := p.changes(ctx, vgc, c, cluster)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", p.name, err))
+			continue
+		}
+
+		// step: correct through the phase the way configure runs it, then read it again to tell which changes remain
+		corrected := make(map[int]bool)
+		if correct[p.name] && len(changes) != 0 {
+			if err := runPhase(ctx, vgc, c, cluster, p, id); err != nil {
+				failed = append(failed, fmt.Sprintf("%v: %v", p.name, err))
+			}
+			remaining, err := p.changes(ctx, vgc, c, cluster)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%v: %v", p.name, err))
+			} else {
+				left := make(map[string]bool)
+				for _, ch := range remaining {
+					left[ch.String()] = true
+				}
+				for i, ch := range changes {
+					if !left[ch.String()] {
+						corrected[i] = true
+					}
+				}
+			}
+		}
+
+		for i, ch := range changes {
+			if !corrected[i] {
+				log.Printf("%v%v: cluster %v drifted: %v", id.Name, id.ID, cluster, ch)
+			}
+			d.Changes = append(d.Changes, driftChange{
+				Kind:      ch.kind,
+				Action:    ch.action,
+				Name:      ch.name,
+				Detail:    ch.detail,
+				Corrected: corrected[i],
+			})
+		}
+	}
+	if len(failed) != 0 {
+		d.Error = strings.Join(failed, "; ")
+	}
+
+	return d
+}
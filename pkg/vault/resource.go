@@ -0,0 +1,205 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
+)
+
+// Resource is data written to an arbitrary vault path, eg a role or the config of a secret backend
+type Resource struct {
+	Path string                 `yaml:"path" json:"path"`
+	Data map[string]interface{} `yaml:"data" json:"data"`
+	// DeleteOnRemove deletes the path once the entry is removed from vault_resources, it needs state_dir
+	DeleteOnRemove bool `yaml:"delete_on_remove,omitempty" json:"delete_on_remove,omitempty"`
+}
+
+// validateResources checks the vault_resources section
+func (g *Config) validateResources() error {
+
+	paths := make(map[string]bool)
+	for i, r := range g.Resource {
+		if r.Path == "" || len(r.Data) == 0 {
+			errm := fmt.Sprintf("vault_resources entry %v needs a path and data", i)
+			return errors.New(errm)
+		}
+		if r.Path == "sys" || strings.HasPrefix(r.Path, "sys/") {
+			errm := fmt.Sprintf("vault_resources entry %v: sys paths are managed by the other phases", i)
+			return errors.New(errm)
+		}
+		if paths[r.Path] {
+			errm := fmt.Sprintf("path %v is declared more than once in vault_resources", r.Path)
+			return errors.New(errm)
+		}
+		paths[r.Path] = true
+		if r.DeleteOnRemove && g.StateDir == "" {
+			errm := fmt.Sprintf("vault_resources entry %v: delete_on_remove needs state_dir to remember the path", r.Path)
+			return errors.New(errm)
+		}
+	}
+
+	return nil
+}
+
+// diffResources compares the declared resources with their live data, live holding nil for the paths that don't exist.
+// Paths in removed were declared with delete_on_remove and no longer are.
+func diffResources(vgc Config, live map[string]map[string]interface{}, removed []string) []change {
+
+	var changes []change
+	for _, r := range vgc.Resource {
+		r := r
+		write := func(ctx context.Context, c *api.Client) error {
+			_, err := c.Write(ctx, r.Path, r.Data)
+			return err
+		}
+		data := live[r.Path]
+		if data == nil {
+			changes = append(changes, change{kind: "resource", action: actionAdd, name: r.Path, apply: write})
+		} else if keys := diffData(r.Data, data); len(keys) != 0 {
+			changes = append(changes, change{kind: "resource", action: actionChange, name: r.Path, detail: "keys " + strings.Join(keys, ","), apply: write})
+		}
+	}
+
+	for _, path := range removed {
+		path := path
+		if live[path] == nil {
+			continue
+		}
+		changes = append(changes, change{
+			kind:   "resource",
+			action: actionRemove,
+			name:   path,
+			detail: "removed from vault_resources",
+			apply: func(ctx context.Context, c *api.Client) error {
+				return c.Delete(ctx, path)
+			},
+		})
+	}
+
+	return changes
+}
+
+// removedResources returns the paths of the state that are no longer declared with delete_on_remove
+func (g *Config) removedResources(st *clusterState) []string {
+
+	declared := make(map[string]bool)
+	for _, r := range g.Resource {
+		declared[r.Path] = true
+	}
+
+	var removed []string
+	for _, path := range st.Resources {
+		if !declared[path] {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(removed)
+
+	return removed
+}
+
+// readResources reads the live data of the declared paths and of the removed ones
+func readResources(ctx context.Context, vgc Config, c *api.Client, removed []string) (map[string]map[string]interface{}, error) {
+
+	live := make(map[string]map[string]interface{})
+	paths := append([]string(nil), removed...)
+	for _, r := range vgc.Resource {
+		paths = append(paths, r.Path)
+	}
+	for _, path := range paths {
+		data, err := c.Read(ctx, path)
+		if err != nil {
+			errm := fmt.Sprintf("unable to read %v: %v", path, err)
+			return nil, errors.New(errm)
+		}
+		if data != nil {
+			live[path] = data
+		}
+	}
+
+	return live, nil
+}
+
+// resourceState loads the cluster state, which is only needed when delete_on_remove is used
+func resourceState(vgc Config, cluster string) (*clusterState, error) {
+	if vgc.StateDir == "" {
+		return &clusterState{}, nil
+	}
+	return vgc.loadState(cluster)
+}
+
+// resourceChanges reads the declared resources of a cluster and compares them with their live data
+func resourceChanges(ctx context.Context, vgc Config, c *api.Client, cluster string) ([]change, error) {
+
+	st, err := resourceState(vgc, cluster)
+	if err != nil {
+		return nil, err
+	}
+	removed := vgc.removedResources(st)
+	live, err := readResources(ctx, vgc, c, removed)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffResources(vgc, live, removed), nil
+}
+
+// runResourcePhase applies the resource changes and records the paths to delete once they are removed from the config
+func runResourcePhase(ctx context.Context, vgc Config, c *api.Client, cluster string, id WorkerID) error {
+
+	st, err := resourceState(vgc, cluster)
+	if err != nil {
+		return err
+	}
+	removed := vgc.removedResources(st)
+	live, err := readResources(ctx, vgc, c, removed)
+	if err != nil {
+		return err
+	}
+	changes := diffResources(vgc, live, removed)
+	failed := applyChanges(ctx, c, cluster, changes, id)
+
+	if vgc.StateDir != "" {
+		// step: removed paths that could not be deleted are kept so that the next run retries
+		var paths []string
+		for _, ch := range failed {
+			if ch.action == actionRemove {
+				paths = append(paths, ch.name)
+			}
+		}
+		for _, r := range vgc.Resource {
+			if r.DeleteOnRemove {
+				paths = append(paths, r.Path)
+			}
+		}
+		sort.Strings(paths)
+		st.Resources = paths
+		if err := vgc.saveState(cluster, st); err != nil {
+			return err
+		}
+	}
+
+	if len(failed) != 0 {
+		errm := fmt.Sprintf("%v of %v changes failed", len(failed), len(changes))
+		return errors.New(errm)
+	}
+
+	return nil
+}
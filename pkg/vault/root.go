@@ -0,0 +1,237 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/stefancocora/vaultguard/pkg/keystore"
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
+)
+
+// where a root token held by vaultguard came from
+const (
+	rootFromInit     = "init"
+	rootFromKeyStore = "keystore"
+	rootFromGenerate = "generate-root"
+)
+
+// otpLen is the length of the sys/generate-root one time pad before vault 1.0, the raw length of a vault token UUID
+const otpLen = 16
+
+// rootToken is a root token only ever held in memory for the duration of a configure run
+type rootToken struct {
+	token  string
+	source string
+}
+
+// String keeps the token out of logs and debug dumps
+func (t rootToken) String() string {
+	return fmt.Sprintf("rootToken{source: %v}", t.source)
+}
+
+// GoString keeps the token out of %#v formatting
+func (t rootToken) GoString() string {
+	return t.String()
+}
+
+// acquireRoot returns a root token for a cluster.
+// The token from a fresh init is used first, then a token left in the keystore by an earlier run
+// and only then a new one is generated through sys/generate-root with the stored unseal key shares.
+func acquireRoot(ctx context.Context, vgc Config, cluster string, c *api.Client, mem *InitResult, id WorkerID) (rootToken, error) {
+
+	if mem != nil && mem.RootToken != "" {
+		return rootToken{token: mem.RootToken, source: rootFromInit}, nil
+	}
+
+	var keys []string
+	if mem != nil {
+		keys = mem.Keys
+	}
+	m, err := vgc.storedMaterial(cluster)
+	if err != nil && err != keystore.ErrNotFound {
+		errm := fmt.Sprintf("%v%v: unable to read the init material of cluster %v: %v", id.Name, id.ID, cluster, err)
+		return rootToken{}, errors.New(errm)
+	}
+	if m != nil {
+		if m.RootToken != "" {
+			if _, err := c.WithToken(m.RootToken).LookupSelf(ctx); err == nil {
+				return rootToken{token: m.RootToken, source: rootFromKeyStore}, nil
+			}
+			log.Printf("%v%v: the root token stored for cluster %v is no longer valid", id.Name, id.ID, cluster)
+		}
+		if len(keys) == 0 {
+			keys = m.Keys
+		}
+	}
+	if len(keys) == 0 {
+		errm := fmt.Sprintf("%v%v: no unseal key shares available to generate a root token for cluster %v", id.Name, id.ID, cluster)
+		return rootToken{}, errors.New(errm)
+	}
+
+	log.Printf("%v%v: generating a root token for cluster %v through %v", id.Name, id.ID, cluster, c.Address())
+	tok, err := generateRoot(ctx, c, keys)
+	if err != nil {
+		errm := fmt.Sprintf("%v%v: unable to generate a root token for cluster %v: %v", id.Name, id.ID, cluster, err)
+		return rootToken{}, errors.New(errm)
+	}
+
+	return rootToken{token: tok, source: rootFromGenerate}, nil
+}
+
+// releaseRoot revokes a root token once the operation that needed it is done.
+// The tokens created with it are orphaned rather than revoked along with it.
+// A token that came from init or the keystore is also removed from the keystore.
+func releaseRoot(ctx context.Context, vgc Config, cluster string, c *api.Client, rt rootToken, id WorkerID) error {
+
+	if err := c.WithToken(rt.token).RevokeOrphan(ctx, rt.token); err != nil {
+		errm := fmt.Sprintf("%v%v: unable to revoke the %v root token of cluster %v: %v", id.Name, id.ID, rt.source, cluster, err)
+		return errors.New(errm)
+	}
+	log.Printf("%v%v: revoked the %v root token of cluster %v", id.Name, id.ID, rt.source, cluster)
+
+	if rt.source == rootFromGenerate {
+		return nil
+	}
+
+	// step: a revoked token is useless, don't keep it around
+	ks, err := vgc.keyStoreFor(cluster)
+	if err != nil || ks == nil {
+		return err
+	}
+	m, err := ks.Get(cluster)
+	if err != nil {
+		if err == keystore.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if m.RootToken == "" {
+		return nil
+	}
+	m.RootToken = ""
+	if err := ks.Put(cluster, m); err != nil {
+		errm := fmt.Sprintf("%v%v: unable to remove the revoked root token of cluster %v from its keystore: %v", id.Name, id.ID, cluster, err)
+		return errors.New(errm)
+	}
+
+	return nil
+}
+
+// generateRoot runs the sys/generate-root OTP flow and returns the decoded root token
+func generateRoot(ctx context.Context, c *api.Client, keys []string) (string, error) {
+
+	st, err := c.GenerateRootAttempt(ctx)
+	if err != nil {
+		return "", err
+	}
+	// step: never cancel an attempt someone else started, it may be an operator in the middle of a recovery
+	if st.Started {
+		return "", errors.New("another sys/generate-root attempt is in progress")
+	}
+
+	// step: vault 1.0 and later report an otp_length and generate the otp themselves, older versions take a UUID sized pad
+	legacy := st.OTPLength == 0
+	otp := ""
+	if legacy {
+		raw := make([]byte, otpLen)
+		if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+			return "", err
+		}
+		otp = base64.StdEncoding.EncodeToString(raw)
+	}
+
+	st, err = c.GenerateRootInit(ctx, otp)
+	if err != nil {
+		return "", err
+	}
+	nonce := st.Nonce
+	if !legacy {
+		otp = st.OTP
+		if otp == "" {
+			c.GenerateRootCancel(ctx)
+			return "", errors.New("vault reported an otp_length but returned no otp from sys/generate-root/attempt")
+		}
+	}
+
+	for i := range keys {
+		st, err = c.GenerateRootUpdate(ctx, keys[i], nonce)
+		if err != nil {
+			c.GenerateRootCancel(ctx)
+			return "", err
+		}
+		if st.Complete {
+			if legacy {
+				return decodeRootToken(st.Encoded(), otp)
+			}
+			return decodeOTPToken(st.Encoded(), otp)
+		}
+	}
+
+	c.GenerateRootCancel(ctx)
+	errm := fmt.Sprintf("threshold not met after submitting %v key shares (%v required)", len(keys), st.Required)
+	return "", errors.New(errm)
+}
+
+// decodeRootToken XORs the encoded token with the otp and formats the result as the token UUID
+func decodeRootToken(encoded string, otp string) (string, error) {
+
+	eb, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	ob, err := base64.StdEncoding.DecodeString(otp)
+	if err != nil {
+		return "", err
+	}
+	if len(eb) != len(ob) || len(eb) != otpLen {
+		errm := fmt.Sprintf("encoded root token is %v bytes, expected the %v byte UUID token of vault before 1.0: unsupported vault version", len(eb), otpLen)
+		return "", errors.New(errm)
+	}
+
+	b := make([]byte, len(eb))
+	for i := range eb {
+		b[i] = eb[i] ^ ob[i]
+	}
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// decodeOTPToken XORs the encoded token with the otp vault 1.0 and later generated, the result is the token itself
+func decodeOTPToken(encoded string, otp string) (string, error) {
+
+	// step: vault switched from padded to unpadded base64 for the encoded token
+	eb, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return "", err
+	}
+	if len(eb) != len(otp) {
+		errm := fmt.Sprintf("encoded root token is %v bytes but the otp is %v: unsupported vault version", len(eb), len(otp))
+		return "", errors.New(errm)
+	}
+
+	b := make([]byte, len(eb))
+	for i := range eb {
+		b[i] = eb[i] ^ otp[i]
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/stefancocora/vaultguard/pkg/secret"
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
+)
+
+const (
+	defaultPasswordLength   = 32
+	defaultPasswordAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// SeedSecret is a KV entry written only when it doesn't exist yet
+type SeedSecret struct {
+	Path   string               `yaml:"path" json:"path"`
+	Values map[string]SeedValue `yaml:"values" json:"values"`
+}
+
+// SeedValue is where the value of a single key comes from, exactly one source is set
+type SeedValue struct {
+	Env string `yaml:"env,omitempty" json:"env,omitempty"`
+	// File is read verbatim apart from trailing newlines
+	File     string        `yaml:"file,omitempty" json:"file,omitempty"`
+	Generate *PasswordSpec `yaml:"generate,omitempty" json:"generate,omitempty"`
+}
+
+// PasswordSpec describes a generated random password
+type PasswordSpec struct {
+	Length   int    `yaml:"length,omitempty" json:"length,omitempty"`
+	Alphabet string `yaml:"alphabet,omitempty" json:"alphabet,omitempty"`
+}
+
+// secretValue is a seeded value, it is sent to vault as a plain string but never shows up in logs or debug dumps
+type secretValue string
+
+// String keeps the value out of logs and debug dumps
+func (s secretValue) String() string {
+	return "<redacted>"
+}
+
+// GoString keeps the value out of %#v formatting
+func (s secretValue) GoString() string {
+	return s.String()
+}
+
+// validateSeedSecrets checks the vault_seed_secrets section, the values themselves are only read when they are written
+func (g *Config) validateSeedSecrets() error {
+
+	paths := make(map[string]bool)
+	for i, s := range g.SeedSecrets {
+		if s.Path == "" || len(s.Values) == 0 {
+			errm := fmt.Sprintf("vault_seed_secrets entry %v needs a path and values", i)
+			return errors.New(errm)
+		}
+		if paths[s.Path] {
+			errm := fmt.Sprintf("path %v is declared more than once in vault_seed_secrets", s.Path)
+			return errors.New(errm)
+		}
+		paths[s.Path] = true
+		for k, v := range s.Values {
+			if err := v.validate(); err != nil {
+				errm := fmt.Sprintf("seed secret %v key %v: %v", s.Path, k, err)
+				return errors.New(errm)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (v SeedValue) validate() error {
+
+	n := 0
+	if v.Env != "" {
+		n++
+	}
+	if v.File != "" {
+		n++
+	}
+	if v.Generate != nil {
+		n++
+		if v.Generate.Length < 0 {
+			errm := fmt.Sprintf("invalid password length %v", v.Generate.Length)
+			return errors.New(errm)
+		}
+		if v.Generate.Alphabet != "" && len(uniqueRunes(v.Generate.Alphabet)) < 2 {
+			return errors.New("the password alphabet needs at least two distinct characters")
+		}
+	}
+	if n != 1 {
+		return errors.New("exactly one of env, file and generate is required")
+	}
+
+	return nil
+}
+
+// resolve reads or generates the value
+func (v SeedValue) resolve() (secretValue, error) {
+
+	switch {
+	case v.Env != "":
+		s := os.Getenv(v.Env)
+		if s == "" {
+			errm := fmt.Sprintf("env var %v is empty", v.Env)
+			return "", errors.New(errm)
+		}
+		return secretValue(s), nil
+	case v.File != "":
+		b, err := ioutil.ReadFile(v.File)
+		if err != nil {
+			return "", err
+		}
+		defer secret.Zero(b)
+		return secretValue(strings.TrimRight(string(b), "\r\n")), nil
+	}
+
+	return generatePassword(*v.Generate)
+}
+
+// generatePassword picks every character uniformly from the alphabet with crypto/rand
+func generatePassword(p PasswordSpec) (secretValue, error) {
+
+	length := p.Length
+	if length == 0 {
+		length = defaultPasswordLength
+	}
+	alphabet := p.Alphabet
+	if alphabet == "" {
+		alphabet = defaultPasswordAlphabet
+	}
+	runes := uniqueRunes(alphabet)
+
+	max := big.NewInt(int64(len(runes)))
+	out := make([]rune, length)
+	for i := range out {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		out[i] = runes[n.Int64()]
+	}
+
+	return secretValue(out), nil
+}
+
+// uniqueRunes returns the distinct characters of an alphabet so that repeated ones aren't more likely
+func uniqueRunes(s string) []rune {
+
+	seen := make(map[rune]bool)
+	var runes []rune
+	for _, r := range s {
+		if !seen[r] {
+			seen[r] = true
+			runes = append(runes, r)
+		}
+	}
+
+	return runes
+}
+
+// kvPath returns the path to read and write a KV entry at and whether its mount is version 2, which nests entries under data/
+func kvPath(mounts map[string]*api.MountOutput, path string) (string, bool) {
+
+	var mount string
+	for m := range mounts {
+		if strings.HasPrefix(path+"/", m) && len(m) > len(mount) {
+			mount = m
+		}
+	}
+	if mount == "" || mounts[mount].Options["version"] != "2" {
+		return path, false
+	}
+
+	return mount + "data/" + strings.TrimPrefix(path, mount), true
+}
+
+// seedChanges returns a change for every seed secret that doesn't exist yet
+func seedChanges(ctx context.Context, vgc Config, c *api.Client, cluster string) ([]change, error) {
+
+	if len(vgc.SeedSecrets) == 0 {
+		return nil, nil
+	}
+	mounts, err := c.ListMounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []change
+	for _, s := range vgc.SeedSecrets {
+		s := s
+		path, v2 := kvPath(mounts, s.Path)
+		live, err := c.Read(ctx, path)
+		if err != nil {
+			errm := fmt.Sprintf("unable to read %v: %v", s.Path, err)
+			return nil, errors.New(errm)
+		}
+		if live != nil {
+			continue
+		}
+
+		var keys []string
+		for k := range s.Values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		changes = append(changes, change{
+			kind:   "seed",
+			action: actionAdd,
+			name:   s.Path,
+			detail: "keys " + strings.Join(keys, ","),
+			apply: func(ctx context.Context, c *api.Client) error {
+				data := make(map[string]interface{})
+				for _, k := range keys {
+					v, err := s.Values[k].resolve()
+					if err != nil {
+						errm := fmt.Sprintf("key %v: %v", k, err)
+						return errors.New(errm)
+					}
+					data[k] = v
+				}
+				if v2 {
+					// step: check-and-set 0 only writes the entry if it still doesn't exist
+					data = map[string]interface{}{
+						"options": map[string]interface{}{"cas": 0},
+						"data":    data,
+					}
+				}
+				_, err := c.Write(ctx, path, data)
+				return err
+			},
+		})
+	}
+
+	return changes, nil
+}
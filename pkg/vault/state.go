@@ -0,0 +1,123 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// clusterState is what vaultguard remembers about the objects it created in a cluster.
+// It never holds secrets, only what is needed to find those objects again.
+type clusterState struct {
+	Tokens map[string]tokenState `json:"tokens,omitempty"`
+	// Resources are the vault_resources paths declared with delete_on_remove
+	Resources []string `json:"resources,omitempty"`
+}
+
+// tokenState tracks a token created by the gentoken phase
+type tokenState struct {
+	Accessor string    `json:"accessor"`
+	Created  time.Time `json:"created"`
+}
+
+// statePath returns the state file of a cluster
+func (g *Config) statePath(cluster string) (string, error) {
+
+	if g.StateDir == "" {
+		return "", errors.New("state_dir is not configured")
+	}
+	if cluster == "" || cluster == "." || cluster == ".." || strings.ContainsAny(cluster, "/\\") {
+		errm := fmt.Sprintf("invalid cluster name %q", cluster)
+		return "", errors.New(errm)
+	}
+
+	return filepath.Join(g.StateDir, cluster+".json"), nil
+}
+
+// loadState reads the state of a cluster, a missing state file is an empty state
+func (g *Config) loadState(cluster string) (*clusterState, error) {
+
+	path, err := g.statePath(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &clusterState{}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		errm := fmt.Sprintf("unable to decode state file %v: %v", path, err)
+		return nil, errors.New(errm)
+	}
+
+	return st, nil
+}
+
+// saveState writes the state of a cluster
+func (g *Config) saveState(cluster string, st *clusterState) error {
+
+	path, err := g.statePath(cluster)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, b, 0600)
+}
+
+// writeFileAtomic writes to a temporary file and renames it so that a crash never leaves a truncated file behind
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
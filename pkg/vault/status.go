@@ -0,0 +1,99 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"sync"
+	"time"
+)
+
+// Status is what the configure worker publishes on the /status endpoint
+type Status struct {
+	mu      sync.Mutex
+	transit map[string]clusterTransit
+	drift   map[string]clusterDrift
+}
+
+// clusterTransit is the transit key status of a cluster as of Updated
+type clusterTransit struct {
+	Updated time.Time          `json:"updated"`
+	Keys    []TransitKeyStatus `json:"keys"`
+}
+
+// TransitKeyStatus is the rotation state of a transit key
+type TransitKeyStatus struct {
+	Key           string     `json:"key"`
+	LatestVersion int        `json:"latest_version"`
+	LastRotation  time.Time  `json:"last_rotation"`
+	NextRotation  *time.Time `json:"next_rotation,omitempty"`
+}
+
+// NewStatus creates an empty Status
+func NewStatus() *Status {
+	return &Status{
+		transit: make(map[string]clusterTransit),
+		drift:   make(map[string]clusterDrift),
+	}
+}
+
+// setTransit replaces the transit key status of a cluster
+func (s *Status) setTransit(cluster string, keys []TransitKeyStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transit[cluster] = clusterTransit{Updated: time.Now().UTC(), Keys: keys}
+}
+
+// setDrift replaces the outcome of the last reconcile of a cluster
+func (s *Status) setDrift(cluster string, d clusterDrift) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drift[cluster] = d
+}
+
+// nextRotation returns when the first transit key of a cluster is due for rotation
+func (s *Status) nextRotation(cluster string) (time.Time, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var next time.Time
+	for _, k := range s.transit[cluster].Keys {
+		if k.NextRotation != nil && (next.IsZero() || k.NextRotation.Before(next)) {
+			next = *k.NextRotation
+		}
+	}
+
+	return next, !next.IsZero()
+}
+
+// Report returns the status by cluster, it satisfies the server Reporter interface
+func (s *Status) Report() interface{} {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transit := make(map[string]clusterTransit)
+	for cl, t := range s.transit {
+		transit[cl] = t
+	}
+	drift := make(map[string]clusterDrift)
+	for cl, d := range s.drift {
+		drift[cl] = d
+	}
+
+	return struct {
+		Transit map[string]clusterTransit `json:"transit,omitempty"`
+		Drift   map[string]clusterDrift   `json:"drift,omitempty"`
+	}{transit, drift}
+}
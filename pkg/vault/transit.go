@@ -0,0 +1,336 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
+)
+
+// TransitKey is a named encryption key of a transit backend
+type TransitKey struct {
+	Name string `yaml:"name" json:"name"`
+	// Type defaults to the transit default, aes256-gcm96, and can't change once the key exists
+	Type            string `yaml:"type,omitempty" json:"type,omitempty"`
+	Exportable      bool   `yaml:"exportable,omitempty" json:"exportable,omitempty"`
+	DeletionAllowed bool   `yaml:"deletion_allowed,omitempty" json:"deletion_allowed,omitempty"`
+	// MinDecryptionVersion is left alone when it is 0
+	MinDecryptionVersion int `yaml:"min_decryption_version,omitempty" json:"min_decryption_version,omitempty"`
+	// RotateEvery rotates the key once its latest version is older than this duration, eg "720h"
+	RotateEvery string `yaml:"rotate_every,omitempty" json:"rotate_every,omitempty"`
+}
+
+// transitKey is a transit key as vault reports it
+type transitKey struct {
+	Type                 string
+	Exportable           bool
+	DeletionAllowed      bool
+	MinDecryptionVersion int
+	LatestVersion        int
+	LastRotation         time.Time
+}
+
+// validateTransitKeys checks the transit keys of the secret backends
+func (g *Config) validateTransitKeys() error {
+
+	for _, b := range g.Backends {
+		path := mountPath(b.Mountpath)
+		if len(b.TransitKeys) != 0 && b.Type != "transit" {
+			errm := fmt.Sprintf("secret backend %v: transit_keys are only valid on transit backends", path)
+			return errors.New(errm)
+		}
+		names := make(map[string]bool)
+		for i, k := range b.TransitKeys {
+			if k.Name == "" || strings.Contains(k.Name, "/") || names[k.Name] {
+				errm := fmt.Sprintf("secret backend %v: transit key %v needs a unique name", path, i)
+				return errors.New(errm)
+			}
+			names[k.Name] = true
+			if k.MinDecryptionVersion < 0 {
+				errm := fmt.Sprintf("transit key %v%v: invalid min_decryption_version %v", path, k.Name, k.MinDecryptionVersion)
+				return errors.New(errm)
+			}
+			if _, err := k.rotateEvery(); err != nil {
+				errm := fmt.Sprintf("transit key %v%v: invalid rotate_every %v", path, k.Name, k.RotateEvery)
+				return errors.New(errm)
+			}
+		}
+	}
+
+	return nil
+}
+
+// rotateEvery returns the rotation period, zero meaning the key is never rotated
+func (k TransitKey) rotateEvery() (time.Duration, error) {
+
+	if k.RotateEvery == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(k.RotateEvery)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("the rotation period must be positive")
+	}
+
+	return d, nil
+}
+
+// readTransitKey reads a transit key, nil when it doesn't exist
+func readTransitKey(ctx context.Context, c *api.Client, path string) (*transitKey, error) {
+
+	data, err := c.Read(ctx, path)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	k := &transitKey{}
+	k.Type, _ = data["type"].(string)
+	k.Exportable, _ = data["exportable"].(bool)
+	k.DeletionAllowed, _ = data["deletion_allowed"].(bool)
+	if v, ok := data["min_decryption_version"].(float64); ok {
+		k.MinDecryptionVersion = int(v)
+	}
+	if v, ok := data["latest_version"].(float64); ok {
+		k.LatestVersion = int(v)
+	}
+
+	// step: symmetric keys report the creation time of every version as a unix time, asymmetric ones as an RFC3339 creation_time
+	keys, _ := data["keys"].(map[string]interface{})
+	switch v := keys[fmt.Sprint(k.LatestVersion)].(type) {
+	case float64:
+		k.LastRotation = time.Unix(int64(v), 0).UTC()
+	case map[string]interface{}:
+		if s, ok := v["creation_time"].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				k.LastRotation = t.UTC()
+			}
+		}
+	}
+
+	return k, nil
+}
+
+// transitKeyPath returns the path of a transit key, eg "transit/keys/app"
+func transitKeyPath(b Backend, k TransitKey) string {
+	return mountPath(b.Mountpath) + "keys/" + k.Name
+}
+
+// readTransitKeys reads the declared transit keys of the mounted transit backends, keyed by their path
+func readTransitKeys(ctx context.Context, vgc Config, c *api.Client) (map[string]*transitKey, error) {
+
+	mounts, err := c.ListMounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]*transitKey)
+	for _, b := range vgc.Backends {
+		if m, ok := mounts[mountPath(b.Mountpath)]; !ok || m.Type != b.Type {
+			continue
+		}
+		for _, k := range b.TransitKeys {
+			path := transitKeyPath(b, k)
+			lk, err := readTransitKey(ctx, c, path)
+			if err != nil {
+				errm := fmt.Sprintf("unable to read %v: %v", path, err)
+				return nil, errors.New(errm)
+			}
+			if lk != nil {
+				live[path] = lk
+			}
+		}
+	}
+
+	return live, nil
+}
+
+// diffTransit compares the declared transit keys with the live ones and rotates the keys that are due at now
+func diffTransit(vgc Config, live map[string]*transitKey, now time.Time) []change {
+
+	var changes []change
+	for _, b := range vgc.Backends {
+		for _, k := range b.TransitKeys {
+			k := k
+			path := transitKeyPath(b, k)
+			lk, ok := live[path]
+			if !ok {
+				changes = append(changes, change{
+					kind:   "transit-key",
+					action: actionAdd,
+					name:   path,
+					detail: "type " + k.keyType(),
+					apply: func(ctx context.Context, c *api.Client) error {
+						return createTransitKey(ctx, c, path, k)
+					},
+				})
+				continue
+			}
+
+			if lk.Type != k.keyType() {
+				changes = append(changes, change{
+					kind:   "transit-key",
+					action: actionChange,
+					name:   path,
+					detail: fmt.Sprintf("type %v exists where %v is declared, the type of a key can't change", lk.Type, k.keyType()),
+				})
+				continue
+			}
+			if lk.Exportable && !k.Exportable {
+				changes = append(changes, change{
+					kind:   "transit-key",
+					action: actionChange,
+					name:   path,
+					detail: "exportable can't be unset once a key is exportable",
+				})
+			}
+
+			cfg := make(map[string]interface{})
+			var details []string
+			if k.Exportable && !lk.Exportable {
+				cfg["exportable"] = true
+				details = append(details, "exportable false -> true")
+			}
+			if k.DeletionAllowed != lk.DeletionAllowed {
+				cfg["deletion_allowed"] = k.DeletionAllowed
+				details = append(details, fmt.Sprintf("deletion_allowed %v -> %v", lk.DeletionAllowed, k.DeletionAllowed))
+			}
+			if k.MinDecryptionVersion != 0 && k.MinDecryptionVersion != lk.MinDecryptionVersion {
+				cfg["min_decryption_version"] = k.MinDecryptionVersion
+				details = append(details, fmt.Sprintf("min_decryption_version %v -> %v", lk.MinDecryptionVersion, k.MinDecryptionVersion))
+			}
+			if len(details) != 0 {
+				changes = append(changes, change{
+					kind:   "transit-key",
+					action: actionChange,
+					name:   path,
+					detail: strings.Join(details, ", "),
+					apply: func(ctx context.Context, c *api.Client) error {
+						_, err := c.Write(ctx, path+"/config", cfg)
+						return err
+					},
+				})
+			}
+
+			if next, ok := k.nextRotation(lk); ok && !now.Before(next) {
+				changes = append(changes, change{
+					kind:   "transit-rotate",
+					action: actionChange,
+					name:   path,
+					detail: fmt.Sprintf("version %v was created %v, rotation due every %v", lk.LatestVersion, lk.LastRotation.Format(time.RFC3339), k.RotateEvery),
+					apply: func(ctx context.Context, c *api.Client) error {
+						_, err := c.Write(ctx, path+"/rotate", nil)
+						return err
+					},
+				})
+			}
+		}
+	}
+
+	return changes
+}
+
+func (k TransitKey) keyType() string {
+	if k.Type == "" {
+		return "aes256-gcm96"
+	}
+	return k.Type
+}
+
+// nextRotation returns when a live key is due for rotation, false when it is never rotated
+func (k TransitKey) nextRotation(lk *transitKey) (time.Time, bool) {
+
+	every, _ := k.rotateEvery()
+	if every == 0 || lk.LastRotation.IsZero() {
+		return time.Time{}, false
+	}
+
+	return lk.LastRotation.Add(every), true
+}
+
+// createTransitKey creates a transit key and applies the settings that can only be set through its config
+func createTransitKey(ctx context.Context, c *api.Client, path string, k TransitKey) error {
+
+	in := map[string]interface{}{"type": k.keyType()}
+	if k.Exportable {
+		in["exportable"] = true
+	}
+	if _, err := c.Write(ctx, path, in); err != nil {
+		return err
+	}
+
+	cfg := make(map[string]interface{})
+	if k.DeletionAllowed {
+		cfg["deletion_allowed"] = true
+	}
+	if k.MinDecryptionVersion > 1 {
+		cfg["min_decryption_version"] = k.MinDecryptionVersion
+	}
+	if len(cfg) == 0 {
+		return nil
+	}
+	_, err := c.Write(ctx, path+"/config", cfg)
+
+	return err
+}
+
+// transitChanges reads the declared transit keys of a cluster and compares them with the live ones
+func transitChanges(ctx context.Context, vgc Config, c *api.Client, cluster string) ([]change, error) {
+
+	live, err := readTransitKeys(ctx, vgc, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffTransit(vgc, live, time.Now()), nil
+}
+
+// transitStatus reports the rotation state of the declared transit keys that exist
+func transitStatus(ctx context.Context, vgc Config, c *api.Client) ([]TransitKeyStatus, error) {
+
+	live, err := readTransitKeys(ctx, vgc, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []TransitKeyStatus
+	for _, b := range vgc.Backends {
+		for _, k := range b.TransitKeys {
+			path := transitKeyPath(b, k)
+			lk, ok := live[path]
+			if !ok {
+				continue
+			}
+			ks := TransitKeyStatus{
+				Key:           path,
+				LatestVersion: lk.LatestVersion,
+				LastRotation:  lk.LastRotation,
+			}
+			if next, ok := k.nextRotation(lk); ok {
+				ks.NextRotation = &next
+			}
+			keys = append(keys, ks)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+
+	return keys, nil
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stefancocora/vaultguard/pkg/keystore"
+	"github.com/stefancocora/vaultguard/pkg/secret"
+)
+
+const (
+	defaultUnsealInterval = 10 * time.Second
+	// how long a partial unseal may sit at the same progress before it is reset, custodians need time to submit theirs
+	unsealStallTimeout = time.Hour
+)
+
+// UnsealKeys carries the unseal key shares of a single cluster to the unseal worker
+type UnsealKeys struct {
+	Cluster string
+	Keys    []string
+}
+
+// UnsealErr is reported by the unseal worker when a node could not be unsealed
+type UnsealErr struct {
+	Cluster   string
+	Node      string
+	Progress  int
+	Threshold int
+	Err       error
+}
+
+func (e *UnsealErr) Error() string {
+	return fmt.Sprintf("unseal: cluster %v node %v still sealed (progress %v/%v): %v", e.Cluster, e.Node, e.Progress, e.Threshold, e.Err)
+}
+
+// UnsealOK is reported by the unseal worker when a node is unsealed.
+// It implements error so that it can be sent over the worker error channel next to UnsealErr.
+type UnsealOK struct {
+	Cluster string
+	Node    string
+}
+
+func (e *UnsealOK) Error() string {
+	return fmt.Sprintf("unseal: cluster %v node %v is unsealed", e.Cluster, e.Node)
+}
+
+// unsealNode holds what the unseal worker remembers about a node between polls
+type unsealNode struct {
+	progress int
+	// moved is when the progress last changed
+	moved time.Time
+	// nonce is the unseal attempt our shares were submitted to
+	nonce    string
+	reported string
+}
+
+// unsealInterval returns how often the unseal worker polls the discovered nodes
+func (g *Config) unsealInterval() (time.Duration, error) {
+	if g.UnsealInterval == "" {
+		return defaultUnsealInterval, nil
+	}
+	d, err := time.ParseDuration(g.UnsealInterval)
+	if err != nil || d <= 0 {
+		errm := fmt.Sprintf("invalid unseal_interval %v", g.UnsealInterval)
+		return 0, errors.New(errm)
+	}
+	return d, nil
+}
+
+// RunUnseal polls the seal status of every discovered vault node and submits key shares to the sealed ones
+func RunUnseal(ctx context.Context, vgc Config, wg *sync.WaitGroup, retErrCh chan error, dvCh chan map[string][]string, keyCh chan UnsealKeys, id WorkerID) error {
+
+	defer wg.Done()
+	defer log.Printf("%v%v: worker shutdown complete", id.Name, id.ID)
+
+	var dv map[string][]string
+	select {
+	case <-ctx.Done():
+		log.Printf("%v%v: caller has asked us to stop processing work; shutting down.", id.Name, id.ID)
+		return nil
+	case dv = <-dvCh:
+	}
+	log.Printf("%v%v: received discovered vault endpoints: %v", id.Name, id.ID, dv)
+
+	interval, err := vgc.unsealInterval()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	keys := loadKeys(vgc, dv, id)
+	nodes := make(map[string]*unsealNode)
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("%v%v: caller has asked us to stop processing work; shutting down.", id.Name, id.ID)
+			return nil
+		case k := <-keyCh:
+			log.Printf("%v%v: received %v unseal key shares for cluster %v", id.Name, id.ID, len(k.Keys), k.Cluster)
+			keys[k.Cluster] = k.Keys
+			unsealClusters(ctx, vgc, dv, keys, nodes, retErrCh, id)
+		case <-ticker.C:
+			unsealClusters(ctx, vgc, dv, keys, nodes, retErrCh, id)
+		}
+	}
+}
+
+// loadKeys reads the unseal key shares of the discovered clusters from their keystores
+func loadKeys(vgc Config, dv map[string][]string, id WorkerID) map[string][]string {
+
+	keys := make(map[string][]string)
+	for cl := range dv {
+		ks, err := vgc.keyStoreFor(cl)
+		if err != nil {
+			log.Printf("%v%v: unable to open the keystore of cluster %v: %v", id.Name, id.ID, cl, err)
+			continue
+		}
+		if ks == nil {
+			continue
+		}
+		m, err := ks.Get(cl)
+		if err != nil {
+			if err == keystore.ErrNotFound {
+				log.Printf("%v%v: no unseal key shares stored for cluster %v", id.Name, id.ID, cl)
+			} else {
+				log.Printf("%v%v: unable to read the unseal key shares of cluster %v: %v", id.Name, id.ID, cl, err)
+			}
+			continue
+		}
+		log.Printf("%v%v: loaded %v unseal key shares for cluster %v from its keystore", id.Name, id.ID, len(m.Keys), cl)
+		keys[cl] = m.Keys
+	}
+
+	return keys
+}
+
+// unsealClusters runs a single unseal pass over every discovered node
+func unsealClusters(ctx context.Context, vgc Config, dv map[string][]string, keys map[string][]string, nodes map[string]*unsealNode, retErrCh chan error, id WorkerID) {
+
+	var clusters []string
+	for cl := range dv {
+		clusters = append(clusters, cl)
+	}
+	sort.Strings(clusters)
+
+	for _, cl := range clusters {
+		for _, n := range dv[cl] {
+			st, ok := nodes[n]
+			if !ok {
+				st = &unsealNode{}
+				nodes[n] = st
+			}
+			kb := shareBytes(keys[cl])
+			res := unsealNodeOnce(ctx, vgc, cl, n, kb, st, id)
+			zeroShares(kb)
+			if res == nil || res.Error() == st.reported {
+				continue
+			}
+			st.reported = res.Error()
+			sendErr(ctx, retErrCh, res)
+		}
+	}
+}
+
+// unsealNodeOnce reads the seal status of a node and, if it's sealed, submits key shares until it unseals.
+// It returns an *UnsealOK or an *UnsealErr describing the state of the node.
+func unsealNodeOnce(ctx context.Context, vgc Config, cluster string, node string, keys [][]byte, st *unsealNode, id WorkerID) error {
+
+	c, err := vgc.newClient(cluster, node)
+	if err != nil {
+		return &UnsealErr{Cluster: cluster, Node: node, Err: err}
+	}
+
+	ss, err := c.SealStatus(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return &UnsealErr{Cluster: cluster, Node: node, Err: err}
+	}
+	if !ss.Sealed {
+		*st = unsealNode{reported: st.reported}
+		return &UnsealOK{Cluster: cluster, Node: node}
+	}
+
+	// step: only a partial unseal that hasn't moved for a long time is reset, custodians may still be submitting theirs
+	now := time.Now()
+	if ss.Progress != st.progress || st.moved.IsZero() {
+		st.progress, st.moved = ss.Progress, now
+	}
+	if ss.Progress > 0 && now.Sub(st.moved) >= unsealStallTimeout {
+		log.Printf("%v%v: partial unseal of node %v stalled at %v/%v for %v, resetting", id.Name, id.ID, node, ss.Progress, ss.T, unsealStallTimeout)
+		if _, err := c.UnsealReset(ctx); err != nil {
+			return &UnsealErr{Cluster: cluster, Node: node, Progress: ss.Progress, Threshold: ss.T, Err: err}
+		}
+		*st = unsealNode{reported: st.reported, moved: now}
+		ss.Progress, ss.Nonce = 0, ""
+	}
+
+	// step: our shares already count towards the current attempt, resubmitting them would not move it
+	if ss.Progress > 0 && st.nonce != "" && ss.Nonce == st.nonce {
+		return &UnsealErr{Cluster: cluster, Node: node, Progress: ss.Progress, Threshold: ss.T, Err: errors.New("waiting for the custodians to submit the remaining key shares")}
+	}
+
+	if len(keys) == 0 {
+		return &UnsealErr{Cluster: cluster, Node: node, Progress: ss.Progress, Threshold: ss.T, Err: errors.New("no unseal key shares available")}
+	}
+
+	// step: submit shares until the threshold is met
+	for i := range keys {
+		resp, err := c.Unseal(ctx, keys[i])
+		if err != nil {
+			return &UnsealErr{Cluster: cluster, Node: node, Progress: st.progress, Threshold: ss.T, Err: err}
+		}
+		if dbgVaultPkg {
+			log.Printf("%v%v: submitted key share %v to node %v, progress %v/%v", id.Name, id.ID, i+1, node, resp.Progress, resp.T)
+		}
+		st.progress, st.moved, st.nonce = resp.Progress, time.Now(), resp.Nonce
+		if !resp.Sealed {
+			*st = unsealNode{reported: st.reported}
+			log.Printf("%v%v: node %v of cluster %v unsealed", id.Name, id.ID, node, cluster)
+			return &UnsealOK{Cluster: cluster, Node: node}
+		}
+	}
+
+	errm := fmt.Sprintf("threshold not met after submitting %v key shares", len(keys))
+	uerr := &UnsealErr{Cluster: cluster, Node: node, Progress: st.progress, Threshold: ss.T, Err: errors.New(errm)}
+	if len(keys) < ss.T {
+		// we only hold part of the shares, leave the progress for whoever holds the rest
+		return uerr
+	}
+
+	// step: all the shares are in and the node is still sealed, don't leave a partial unseal behind
+	if _, err := c.UnsealReset(ctx); err != nil {
+		log.Printf("%v%v: unable to reset the unseal progress of node %v: %v", id.Name, id.ID, node, err)
+	}
+	*st = unsealNode{reported: st.reported}
+
+	return uerr
+}
+
+// shareBytes copies the key shares into buffers the unseal call can submit and zeroShares can wipe
+func shareBytes(keys []string) [][]byte {
+
+	kb := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		kb = append(kb, []byte(k))
+	}
+
+	return kb
+}
+
+// zeroShares overwrites the key shares once they have been submitted
+func zeroShares(keys [][]byte) {
+	for i := range keys {
+		secret.Zero(keys[i])
+	}
+}
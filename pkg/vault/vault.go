@@ -28,6 +28,9 @@ import (
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/spf13/viper"
+	"github.com/stefancocora/vaultguard/pkg/discover"
+	"github.com/stefancocora/vaultguard/pkg/keystore"
+	"github.com/stefancocora/vaultguard/pkg/vault/api"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -51,6 +54,15 @@ type VConf struct {
 	Backends  []Backend   `yaml:"vault_backends" json:"vault_backends"`
 	Endpoints []Endpoints `yaml:"vault_endpoints" json:"vault_endpoints"`
 	Policy    []Policy    `yaml:"vault_policies" json:"vault_policies"`
+	Tokens    []Token     `yaml:"vault_tokens,omitempty" json:"vault_tokens,omitempty"`
+	// AuthBackends are the auth methods managed by the auth phase
+	AuthBackends []AuthBackend `yaml:"vault_auth_backends,omitempty" json:"vault_auth_backends,omitempty"`
+	// AuditDevices are enabled by the audit phase right after unseal
+	AuditDevices []AuditDevice `yaml:"vault_audit_devices,omitempty" json:"vault_audit_devices,omitempty"`
+	// Resource holds the arbitrary paths written by the resources phase, eg roles of a secret backend
+	Resource []Resource `yaml:"vault_resources,omitempty" json:"vault_resources,omitempty"`
+	// SeedSecrets are KV entries the seed phase writes only when they don't exist yet
+	SeedSecrets []SeedSecret `yaml:"vault_seed_secrets,omitempty" json:"vault_seed_secrets,omitempty"`
 }
 
 // GuardConfig is the struct containing vaultguard configuration
@@ -62,31 +74,90 @@ type GuardConfig struct {
 	Gentoken bool   `yaml:"gentoken" json:"gentoken"`
 	Address  string `yaml:"listen_address" json:"listen_address"`
 	Port     string `yaml:"listen_port" json:"listen_port"`
+	TLSCert  string `yaml:"listen_tls_cert,omitempty" json:"listen_tls_cert,omitempty"`
+	TLSKey   string `yaml:"listen_tls_key,omitempty" json:"listen_tls_key,omitempty"`
+	// init phase
+	SecretShares    int `yaml:"secret_shares" json:"secret_shares"`
+	SecretThreshold int `yaml:"secret_threshold" json:"secret_threshold"`
+	// PGP encrypted key shares, one custodian per share
+	Custodians       []Custodian `yaml:"custodians,omitempty" json:"custodians,omitempty"`
+	CustodianMode    bool        `yaml:"custodian_mode" json:"custodian_mode"`
+	PGPPrivateKey    string      `yaml:"pgp_private_key,omitempty" json:"pgp_private_key,omitempty"`
+	PGPPassphraseEnv string      `yaml:"pgp_passphrase_env,omitempty" json:"pgp_passphrase_env,omitempty"`
+	// unseal phase
+	UnsealInterval string `yaml:"unseal_interval,omitempty" json:"unseal_interval,omitempty"`
+	// key ceremony
+	Ceremony Ceremony `yaml:"ceremony,omitempty" json:"ceremony,omitempty"`
+	// where vaultguard keeps track of the objects it created, one file per cluster
+	StateDir string `yaml:"state_dir,omitempty" json:"state_dir,omitempty"`
+	// gentoken phase, tokens are written to <token_dir>/<cluster>/<name>.token
+	TokenDir string `yaml:"token_dir,omitempty" json:"token_dir,omitempty"`
+	// TokenCheckInterval is how often the gentoken phase runs again to recreate expired or revoked tokens
+	TokenCheckInterval string `yaml:"token_check_interval,omitempty" json:"token_check_interval,omitempty"`
+	// mount phase, MountPrune unmounts the secret backends that are not declared instead of only reporting them
+	MountPrune bool `yaml:"mount_prune,omitempty" json:"mount_prune,omitempty"`
+	// policies phase, PolicyPrune deletes the policies that are not declared, root and default are never touched
+	PolicyPrune bool `yaml:"policy_prune,omitempty" json:"policy_prune,omitempty"`
+	// auth phase, AuthPrune disables the auth methods and deletes the roles that are not declared
+	Auth      bool `yaml:"auth" json:"auth"`
+	AuthPrune bool `yaml:"auth_prune,omitempty" json:"auth_prune,omitempty"`
+	// audit phase
+	Audit bool `yaml:"audit" json:"audit"`
+	// resources phase
+	Resources bool `yaml:"resources" json:"resources"`
+	// seed phase
+	Seed bool `yaml:"seed" json:"seed"`
+	// pki phase
+	PKI bool `yaml:"pki" json:"pki"`
+	// transit phase, keys due for rotation are rotated by the configure worker on their schedule
+	Transit bool `yaml:"transit" json:"transit"`
+	// periodic drift detection
+	Reconcile Reconcile `yaml:"reconcile,omitempty" json:"reconcile,omitempty"`
+}
+
+// Custodian is a holder of a single PGP encrypted unseal key share
+type Custodian struct {
+	Name string `yaml:"name" json:"name"`
+	// PGPKey is the path to the custodian armored PGP public key
+	PGPKey string `yaml:"pgp_key" json:"pgp_key"`
+	// Output is the directory the encrypted shares are written to, one file per cluster named after it
+	Output string `yaml:"output,omitempty" json:"output,omitempty"`
+	// Vaultguard marks the share vaultguard itself is allowed to hold in custodian mode
+	Vaultguard bool `yaml:"vaultguard,omitempty" json:"vaultguard,omitempty"`
 }
 
 // Endpoints holds the config for how to get to vault cluster endpoints
 type Endpoints struct {
 	Type  string `yaml:"type" json:"type"`
 	Specs []Spec `yaml:"spec" json:"spec"`
+	// vault API client settings used for every node discovered through this endpoint
+	CACert    string `yaml:"ca_cert,omitempty" json:"ca_cert,omitempty"`
+	Timeout   string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Retries   int    `yaml:"retries,omitempty" json:"retries,omitempty"`
+	RetryWait string `yaml:"retry_wait,omitempty" json:"retry_wait,omitempty"`
+	// where the init material of the clusters discovered through this endpoint is kept
+	KeyStore keystore.Config `yaml:"keystore,omitempty" json:"keystore,omitempty"`
 }
 
-// Spec contains the overall Endpoint definition
-type Spec struct {
-	// ecs
-	Cluster string `yaml:"cluster,omitempty" json:"cluster,omitempty"`
-	Region  string `yaml:"region,omitempty" json:"region,omitempty"`
-	// url
-	URL string `yaml:"url,omitempty" json:"url,omitempty"`
-	// k8s
-	Namespace string `yaml:"namespace,omitempty" json:"namespace,omitempty"`
-	Service   string `yaml:"service,omitempty" json:"service,omitempty"`
-}
+// Spec contains the overall Endpoint definition, the discover package owns it
+type Spec = discover.Spec
 
 // Backend is a definition of a vault secret backend
 type Backend struct {
 	Type        string `yaml:"type" json:"type"`
 	Mountpath   string `yaml:"mountpath" json:"mountpath"`
 	Description string `yaml:"description" json:"description"`
+	// Options are the backend specific mount options, eg version 2 of the kv backend
+	Options map[string]string `yaml:"options,omitempty" json:"options,omitempty"`
+	// Config is applied when mounting and tuned in place when it changes
+	Config TuneConfig `yaml:"config,omitempty" json:"config,omitempty"`
+	// Local and SealWrap can only be set when mounting
+	Local    bool `yaml:"local,omitempty" json:"local,omitempty"`
+	SealWrap bool `yaml:"seal_wrap,omitempty" json:"seal_wrap,omitempty"`
+	// PKI bootstraps the CA of a pki backend
+	PKI *PKIConfig `yaml:"pki,omitempty" json:"pki,omitempty"`
+	// TransitKeys are the keys of a transit backend
+	TransitKeys []TransitKey `yaml:"transit_keys,omitempty" json:"transit_keys,omitempty"`
 }
 
 // Policy is a definition of a policy
@@ -95,23 +166,25 @@ type Policy struct {
 	Policy string `yaml:"policy" json:"policy"`
 }
 
-//
-// EcsSpec is the Endpoint that holds the definition of the requirements to get to a vault service running in AWS ECS
-type EcsSpec struct {
-	Cluster string `yaml:"cluster" json:"cluster"`
-	Region  string `yaml:"region" json:"region"`
+// Token is a definition of a token created by the gentoken phase, always as an orphan as the root token that creates it is revoked
+type Token struct {
+	Name     string   `yaml:"name" json:"name"`
+	Policies []string `yaml:"policies" json:"policies"`
+	TTL      string   `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+	// Periodic tokens use TTL as their period and never expire as long as they are renewed
+	Periodic    bool              `yaml:"periodic,omitempty" json:"periodic,omitempty"`
+	DisplayName string            `yaml:"display_name,omitempty" json:"display_name,omitempty"`
+	Metadata    map[string]string `yaml:"metadata,omitempty" json:"metadata,omitempty"`
 }
 
+// EcsSpec is the Endpoint that holds the definition of the requirements to get to a vault service running in AWS ECS
+type EcsSpec = discover.EcsSpec
+
 // URLSpec is the Endpoint that  holds the definition of the requirements to get to a vault service running at a defined URL
-type URLSpec struct {
-	URL string `yaml:"url" json:"url"`
-}
+type URLSpec = discover.URLSpec
 
 // K8sSpec is the Endpoint that  holds the definition of the requirements to get to a vault service running in a kubernetes cluster
-type K8sSpec struct {
-	Namespace string `yaml:"namespace" json:"namespace"`
-	Service   string `yaml:"service" json:"service"`
-}
+type K8sSpec = discover.K8sSpec
 
 // New sets up the Config struct from the configuration file.
 // It reads from the configuration all the vaultguard config options.
@@ -151,72 +224,247 @@ func (g *Config) New() error {
 		spew.Dump(g)
 	}
 
+	g.normalize()
+
+	if err := g.validate(); err != nil {
+		return err
+	}
+
 	return nil
 
 }
 
-// WorkerID is used to assign goroutine workers a notion of identity, useful when logging
-type WorkerID struct {
-	Name string
-	Type string
-	ID   int
+// normalize brings the decoded config into the form the phases use, it runs before validate which only reads the config
+func (g *Config) normalize() {
+
+	for i := range g.Resource {
+		r := &g.Resource[i]
+		r.Path = strings.Trim(r.Path, "/")
+		// step: yaml decodes nested maps with interface{} keys, which can't be sent to vault
+		r.Data = normalizeMap(r.Data)
+	}
+	for i := range g.AuthBackends {
+		a := &g.AuthBackends[i]
+		a.Config = normalizeMap(a.Config)
+		for name := range a.Roles {
+			a.Roles[name] = normalizeMap(a.Roles[name])
+		}
+	}
+	for i := range g.SeedSecrets {
+		s := &g.SeedSecrets[i]
+		s.Path = strings.Trim(s.Path, "/")
+	}
 }
 
-// RunInit func
-func RunInit(ctx context.Context, vgc Config, wg *sync.WaitGroup, retErrCh chan error, dvCh chan map[string][]string, id WorkerID) error {
+// validate checks the decoded config for values that can't be used at runtime
+func (g *Config) validate() error {
 
-	defer wg.Done()
-	defer log.Printf("%v%v: worker shutdown complete", id.Name, id.ID)
+	if g.Init {
+		if g.SecretShares < 1 {
+			errm := fmt.Sprintf("secret_shares must be at least 1 when init is enabled: %v", g.SecretShares)
+			return errors.New(errm)
+		}
+		if g.SecretThreshold < 1 || g.SecretThreshold > g.SecretShares {
+			errm := fmt.Sprintf("secret_threshold must be between 1 and secret_shares (%v): %v", g.SecretShares, g.SecretThreshold)
+			return errors.New(errm)
+		}
+		if g.SecretShares > 1 && g.SecretThreshold == 1 {
+			return errors.New("secret_threshold must be greater than 1 when secret_shares is greater than 1")
+		}
+		// step: the init material must end up somewhere, the root token of a fresh cluster is revoked after configure
+		if len(g.Custodians) == 0 {
+			for i := range g.Endpoints {
+				if !g.Endpoints[i].KeyStore.Enabled() {
+					errm := fmt.Sprintf("init needs custodians or a keystore on every vault_endpoints entry, entry %v has no keystore", i)
+					return errors.New(errm)
+				}
+			}
+		}
+	}
+
+	if err := g.validateCustodians(); err != nil {
+		return err
+	}
 
-	dv := make(map[string][]string)
-	dv = <-dvCh
-	log.Printf("%v%v: received discovered vault endpoints: %v", id.Name, id.ID, dv)
+	if _, err := g.unsealInterval(); err != nil {
+		return err
+	}
+
+	if err := g.validateCeremony(); err != nil {
+		return err
+	}
 
-	// fake work
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	if err := g.validateTokens(); err != nil {
+		return err
+	}
+
+	if err := g.validateBackends(); err != nil {
+		return err
+	}
 
-	// timeout := time.After(5 * time.Second)
+	if err := g.validatePolicies(); err != nil {
+		return err
+	}
+
+	if err := g.validateAuthBackends(); err != nil {
+		return err
+	}
+
+	if err := g.validateAuditDevices(); err != nil {
+		return err
+	}
+
+	if err := g.validateResources(); err != nil {
+		return err
+	}
+
+	if err := g.validateSeedSecrets(); err != nil {
+		return err
+	}
+
+	if err := g.validateReconcile(); err != nil {
+		return err
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("%v%v: caller has asked us to stop processing work; shutting down.", id.Name, id.ID)
-			return nil
-		// case <-timeout:
-		// 	errm := fmt.Sprintf("%v: timeout while receiving response from the vault server")
-		// 	return errors.New(errm)
-		case t := <-ticker.C:
-			// do some work
-			fmt.Printf("%v%v: working - %s\n", id.Name, id.ID, t.UTC().Format("20060102-150405.000000000"))
+	for i := range g.Endpoints {
+		if err := discover.Validate(g.Endpoints[i].Type, g.Endpoints[i].Specs); err != nil {
+			errm := fmt.Sprintf("invalid vault_endpoints entry %v: %v", i, err)
+			return errors.New(errm)
+		}
+		if _, err := g.Endpoints[i].clientConfig(""); err != nil {
+			errm := fmt.Sprintf("invalid vault_endpoints entry %v: %v", i, err)
+			return errors.New(errm)
+		}
+		if err := g.Endpoints[i].KeyStore.Validate(); err != nil {
+			errm := fmt.Sprintf("invalid vault_endpoints entry %v: %v", i, err)
+			return errors.New(errm)
+		}
+	}
+
+	return nil
+}
+
+// endpointFor returns the vault_endpoints entry a discovered cluster was found through
+func (g *Config) endpointFor(cluster string) (Endpoints, bool) {
+
+	for i := range g.Endpoints {
+		for j := range g.Endpoints[i].Specs {
+			if g.Endpoints[i].Specs[j].Cluster == cluster {
+				return g.Endpoints[i], true
+			}
 		}
 	}
+
+	return Endpoints{}, false
+}
+
+// discovered holds the per node TLS settings of the discovered nodes, keyed by address
+var discovered = struct {
+	sync.Mutex
+	nodes map[string]discover.Node
+}{nodes: make(map[string]discover.Node)}
+
+// RegisterNodes records the discovered nodes so that their own TLS settings replace the ones of their endpoint
+func RegisterNodes(nodes []discover.Node) {
+	discovered.Lock()
+	defer discovered.Unlock()
+	for _, n := range nodes {
+		discovered.nodes[n.Address] = n
+	}
+}
+
+// newClient creates a vault API client for a discovered node using the settings of the endpoint it belongs to
+func (g *Config) newClient(cluster string, addr string) (*api.Client, error) {
+
+	ep, _ := g.endpointFor(cluster)
+	cc, err := ep.clientConfig(addr)
+	if err != nil {
+		return nil, err
+	}
+	discovered.Lock()
+	n, ok := discovered.nodes[addr]
+	discovered.Unlock()
+	if ok {
+		if n.CACert != "" {
+			cc.CACert = n.CACert
+		}
+		cc.TLSServerName = n.TLSServerName
+	}
+
+	return api.New(cc)
+}
+
+// keyStoreFor returns the keystore configured for the endpoint a cluster was discovered through.
+// It returns a nil KeyStore when the endpoint has no keystore configured.
+func (g *Config) keyStoreFor(cluster string) (keystore.KeyStore, error) {
+
+	ep, _ := g.endpointFor(cluster)
+	if !ep.KeyStore.Enabled() {
+		return nil, nil
+	}
+
+	return keystore.New(ep.KeyStore)
 }
 
-// RunUnseal is unsealing the vault
-func RunUnseal(ctx context.Context, vgc Config, wg *sync.WaitGroup, retErrCh chan error, id WorkerID) error {
+// storedMaterial reads the init material of a cluster from its keystore.
+// It returns keystore.ErrNotFound when there is no keystore or nothing stored in it.
+func (g *Config) storedMaterial(cluster string) (*keystore.Material, error) {
 
-	defer wg.Done()
-	defer log.Printf("%v%v: worker shutdown complete", id.Name, id.ID)
+	ks, err := g.keyStoreFor(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if ks == nil {
+		return nil, keystore.ErrNotFound
+	}
 
-	// fake work
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	return ks.Get(cluster)
+}
 
-	// timeout := time.After(5 * time.Second)
+// clientConfig converts the endpoint client settings into a vault API client config
+func (e Endpoints) clientConfig(addr string) (api.Config, error) {
 
-	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("%v%v: caller has asked us to stop processing work; shutting down.", id.Name, id.ID)
-			return nil
-		// case <-timeout:
-		// 	errm := fmt.Sprintf("%v: timeout while receiving response from the vault server")
-		// 	return errors.New(errm)
-		case t := <-ticker.C:
-			// do some work
-			fmt.Printf("%v%v: working - %s\n", id.Name, id.ID, t.UTC().Format("20060102-150405.000000000"))
+	cc := api.Config{
+		Address:    addr,
+		CACert:     e.CACert,
+		MaxRetries: e.Retries,
+	}
+	if e.Retries < 0 {
+		errm := fmt.Sprintf("retries must not be negative: %v", e.Retries)
+		return api.Config{}, errors.New(errm)
+	}
+	if e.Timeout != "" {
+		d, err := time.ParseDuration(e.Timeout)
+		if err != nil {
+			errm := fmt.Sprintf("invalid timeout %v: %v", e.Timeout, err)
+			return api.Config{}, errors.New(errm)
+		}
+		cc.Timeout = d
+	}
+	if e.RetryWait != "" {
+		d, err := time.ParseDuration(e.RetryWait)
+		if err != nil {
+			errm := fmt.Sprintf("invalid retry_wait %v: %v", e.RetryWait, err)
+			return api.Config{}, errors.New(errm)
 		}
+		cc.RetryWait = d
+	}
+
+	return cc, nil
+}
+
+// WorkerID is used to assign goroutine workers a notion of identity, useful when logging
+type WorkerID struct {
+	Name string
+	Type string
+	ID   int
+}
+
+// sendErr reports err to the listener unless the caller has asked us to stop
+func sendErr(ctx context.Context, retErrCh chan error, err error) {
+	select {
+	case <-ctx.Done():
+	case retErrCh <- err:
 	}
 }
 
@@ -224,4 +472,5 @@ func RunUnseal(ctx context.Context, vgc Config, wg *sync.WaitGroup, retErrCh cha
 func PropagateDebug(dbg bool, confDbg bool) {
 	dbgVaultPkg = dbg
 	dbgVaultConf = confDbg
+	api.PropagateDebug(dbg)
 }